@@ -0,0 +1,116 @@
+package main
+
+import (
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+/**
+//===================================================
+//================ CLOCKS ===========================
+//===================================================
+*/
+
+// Clocks is one of the clock sections of a GPU in MHz, eg. <clocks>,
+// <max_clocks> or <applications_clocks>. Not every section has every part.
+type Clocks struct {
+    GraphicsClock string `xml:"graphics_clock"`
+    SmClock string `xml:"sm_clock"`
+    MemClock string `xml:"mem_clock"`
+    VideoClock string `xml:"video_clock"`
+}
+
+type clockMetrics struct {
+    clock                  *prometheus.Desc
+    clockMax               *prometheus.Desc
+    applications           *prometheus.Desc
+    defaultApplications    *prometheus.Desc
+    deferred               *prometheus.Desc
+    maxCustomerBoost       *prometheus.Desc
+    autoBoost              *prometheus.Desc
+    applicationsCustomised *prometheus.Desc
+}
+
+func newClockMetrics(gpuLabels []string) *clockMetrics {
+    return &clockMetrics{
+        clock: newGPUDesc(gpuLabels,
+            "nvidia_clock_mhz",
+            "Current frequency at which parts of the GPU are running. All readings are in MHz.",
+            "part",
+        ),
+        clockMax: newGPUDesc(gpuLabels,
+            "nvidia_clock_max_mhz",
+            "Maximum frequency at which parts of the GPU are design to run. Al readings are in MHz.",
+            "part",
+        ),
+        applications: newGPUDesc(gpuLabels,
+            "nvidia_clock_applications_mhz",
+            "Application clocks in MHz, the clocks applications run at unless boosted. Set with nvidia-smi -ac.",
+            "part",
+        ),
+        defaultApplications: newGPUDesc(gpuLabels,
+            "nvidia_clock_default_applications_mhz",
+            "Default application clocks in MHz, restored by nvidia-smi -rac.",
+            "part",
+        ),
+        deferred: newGPUDesc(gpuLabels,
+            "nvidia_clock_deferred_mhz",
+            "Deferred clocks in MHz, applied on the next GPU reset.",
+            "part",
+        ),
+        maxCustomerBoost: newGPUDesc(gpuLabels,
+            "nvidia_clock_max_customer_boost_mhz",
+            "Maximum customer boost clocks in MHz, the highest clocks the GPU boosts to with auto boost.",
+            "part",
+        ),
+        autoBoost: newGPUDesc(gpuLabels,
+            "nvidia_clock_auto_boost",
+            "Whether auto boost is on (1) or off (0). setting is current or default.",
+            "setting",
+        ),
+        applicationsCustomised: newGPUDesc(gpuLabels,
+            "nvidia_clock_applications_customised",
+            "Whether the application clocks differ from the default application clocks (1), eg. left locked after a benchmark.",
+        ),
+    }
+}
+
+func (m *clockMetrics) describe(ch chan<- *prometheus.Desc) {
+    ch <- m.clock
+    ch <- m.clockMax
+    ch <- m.applications
+    ch <- m.defaultApplications
+    ch <- m.deferred
+    ch <- m.maxCustomerBoost
+    ch <- m.autoBoost
+    ch <- m.applicationsCustomised
+}
+
+func (m *clockMetrics) collect(s gpuSink, gpu []string, GPU *NvidiaSmiGPU) {
+    m.collectClocks(s, gpu, m.clock, "clocks", &GPU.Clocks)
+    m.collectClocks(s, gpu, m.clockMax, "max_clocks", &GPU.MaxClocks)
+    m.collectClocks(s, gpu, m.applications, "applications_clocks", &GPU.ApplicationsClocks)
+    m.collectClocks(s, gpu, m.defaultApplications, "default_applications_clocks", &GPU.DefaultApplicationsClocks)
+    m.collectClocks(s, gpu, m.deferred, "deferred_clocks", &GPU.DeferredClocks)
+    m.collectClocks(s, gpu, m.maxCustomerBoost, "max_customer_boost_clocks", &GPU.MaxCustomerBoostClocks)
+
+    s.gpuFlag(m.autoBoost, gpu, "clock_policy.auto_boost", GPU.ClockPolicy.AutoBoost, "current")
+    s.gpuFlag(m.autoBoost, gpu, "clock_policy.auto_boost_default", GPU.ClockPolicy.AutoBoostDefault, "default")
+
+    // derived, reported when both graphics and memory clocks are known
+    app, def := &GPU.ApplicationsClocks, &GPU.DefaultApplicationsClocks
+    appGraphics, defGraphics := parseValue(app.GraphicsClock), parseValue(def.GraphicsClock)
+    appMem, defMem := parseValue(app.MemClock), parseValue(def.MemClock)
+    if appGraphics.ok() && defGraphics.ok() && appMem.ok() && defMem.ok() {
+        customised := appGraphics.Value != defGraphics.Value || appMem.Value != defMem.Value
+        gauge(s.ch, m.applicationsCustomised, boolToFloat(customised), gpu...)
+    }
+}
+
+// collectClocks sends each part of a clock section, parts a section does
+// not have are left out.
+func (m *clockMetrics) collectClocks(s gpuSink, gpu []string, desc *prometheus.Desc, section string, clocks *Clocks) {
+    s.gpuGauge(desc, gpu, section+".graphics_clock", clocks.GraphicsClock, 1, "graphics")
+    s.gpuGauge(desc, gpu, section+".sm_clock", clocks.SmClock, 1, "sm")
+    s.gpuGauge(desc, gpu, section+".mem_clock", clocks.MemClock, 1, "memory")
+    s.gpuGauge(desc, gpu, section+".video_clock", clocks.VideoClock, 1, "video")
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestClockMetrics(t *testing.T) {
+    // the V100 of q-x-470.xml runs customised application clocks
+    for _, dump := range testDumps {
+        c := newDumpCollector(t, dump, CollectorOpts{})
+        testGolden(t, c, goldenName(dump, "clocks"),
+            "nvidia_clock_mhz",
+            "nvidia_clock_max_mhz",
+            "nvidia_clock_applications_mhz",
+            "nvidia_clock_default_applications_mhz",
+            "nvidia_clock_deferred_mhz",
+            "nvidia_clock_max_customer_boost_mhz",
+            "nvidia_clock_auto_boost",
+            "nvidia_clock_applications_customised",
+        )
+    }
+}
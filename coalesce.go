@@ -0,0 +1,100 @@
+package main
+
+import (
+    "context"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+/**
+//===================================================
+//================ SCRAPE COALESCING ================
+//===================================================
+*/
+
+// queryGroup coalesces concurrent queries: while one query is in flight
+// every other caller waits for and shares its result instead of starting
+// another nvidia-smi process.
+type queryGroup struct {
+    mtx  sync.Mutex
+    call *queryCall
+
+    // coalesced counts the callers that shared another caller's query.
+    coalesced uint64
+}
+
+type queryCall struct {
+    done chan struct{}
+    val  *NvidiaSmiLog
+    err  error
+
+    // waiters is the number of callers still waiting, cancel stops the
+    // query once all of them gave up.
+    waiters int
+    cancel  context.CancelFunc
+}
+
+// maxQueryTime bounds a shared query that no caller gives up on, eg. when
+// every caller runs without a timeout.
+const maxQueryTime = 2 * time.Minute
+
+// do runs fn unless a call is already in flight, in which case it waits
+// for that call. The call runs detached from the callers' contexts so a
+// caller with a short deadline does not fail the others: each caller gives
+// up when its own ctx expires, and the call is cancelled when the last
+// caller gave up or after maxQueryTime.
+func (g *queryGroup) do(ctx context.Context, fn func(ctx context.Context) (*NvidiaSmiLog, error)) (*NvidiaSmiLog, error) {
+    g.mtx.Lock()
+    call := g.call
+    if call != nil {
+        atomic.AddUint64(&g.coalesced, 1)
+    } else {
+        var callCtx context.Context
+        call = &queryCall{done: make(chan struct{})}
+        callCtx, call.cancel = context.WithTimeout(context.Background(), maxQueryTime)
+        g.call = call
+        go g.run(callCtx, call, fn)
+    }
+    call.waiters++
+    g.mtx.Unlock()
+
+    select {
+    case <-call.done:
+        return call.val, call.err
+    case <-ctx.Done():
+        g.leave(call)
+        return nil, ctx.Err()
+    }
+}
+
+func (g *queryGroup) run(ctx context.Context, call *queryCall, fn func(ctx context.Context) (*NvidiaSmiLog, error)) {
+    call.val, call.err = fn(ctx)
+    call.cancel()
+
+    g.mtx.Lock()
+    if g.call == call {
+        g.call = nil
+    }
+    g.mtx.Unlock()
+    close(call.done)
+}
+
+// leave cancels call when the last waiting caller gave up. Later callers
+// start a new call rather than join the cancelled one.
+func (g *queryGroup) leave(call *queryCall) {
+    g.mtx.Lock()
+    defer g.mtx.Unlock()
+    call.waiters--
+    if call.waiters == 0 {
+        call.cancel()
+        if g.call == call {
+            g.call = nil
+        }
+    }
+}
+
+// coalescedCount returns how many callers shared an in flight query.
+func (g *queryGroup) coalescedCount() uint64 {
+    return atomic.LoadUint64(&g.coalesced)
+}
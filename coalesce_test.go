@@ -0,0 +1,84 @@
+package main
+
+import (
+    "context"
+    "testing"
+    "time"
+)
+
+// slowQuery returns a snapshot after d unless its ctx is done first.
+func slowQuery(d time.Duration, started chan<- struct{}) func(ctx context.Context) (*NvidiaSmiLog, error) {
+    return func(ctx context.Context) (*NvidiaSmiLog, error) {
+        close(started)
+        select {
+        case <-time.After(d):
+            return &NvidiaSmiLog{DriverVersion: "535.129.03"}, nil
+        case <-ctx.Done():
+            return nil, ctx.Err()
+        }
+    }
+}
+
+func TestQueryGroupWaiterDeadlines(t *testing.T) {
+    var g queryGroup
+    started := make(chan struct{})
+
+    // the caller that starts the query gives up first
+    short, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+    defer cancel()
+    shortErr := make(chan error, 1)
+    go func() {
+        _, err := g.do(short, slowQuery(100*time.Millisecond, started))
+        shortErr <- err
+    }()
+    <-started
+
+    long, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    l, err := g.do(long, slowQuery(0, make(chan struct{})))
+    if err != nil || l == nil {
+        t.Fatalf("joining caller got %v %v, want the shared snapshot", l, err)
+    }
+    if err := <-shortErr; err != context.DeadlineExceeded {
+        t.Errorf("starting caller got %v, want %v", err, context.DeadlineExceeded)
+    }
+    if n := g.coalescedCount(); n != 1 {
+        t.Errorf("coalesced %d callers, want 1", n)
+    }
+}
+
+func TestQueryGroupCancelWhenAllGaveUp(t *testing.T) {
+    var g queryGroup
+    started := make(chan struct{})
+    var callErr error
+    done := make(chan struct{})
+    fn := func(ctx context.Context) (*NvidiaSmiLog, error) {
+        defer close(done)
+        close(started)
+        <-ctx.Done()
+        callErr = ctx.Err()
+        return nil, callErr
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+    defer cancel()
+    if _, err := g.do(ctx, fn); err != context.DeadlineExceeded {
+        t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+    }
+    <-started
+
+    select {
+    case <-done:
+        if callErr != context.Canceled {
+            t.Errorf("query ended with %v, want %v", callErr, context.Canceled)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("query was not cancelled after its only caller gave up")
+    }
+
+    // the next caller starts a new query
+    l, err := g.do(context.Background(), slowQuery(0, make(chan struct{})))
+    if err != nil || l == nil {
+        t.Errorf("next caller got %v %v, want a new snapshot", l, err)
+    }
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "os/exec"
+    "strings"
+
+    "github.com/prometheus/common/log"
+)
+
+/**
+//===================================================
+//================ RUN COMMAND ======================
+//===================================================
+*/
+
+// runCommand runs name with args and returns its stdout.
+// When ctx expires before the command exits the whole process tree is
+// killed and ctx.Err() is returned, so a hung nvidia-smi never outlives
+// the scrape that started it.
+func runCommand(ctx context.Context, name string, args ...string) ([]byte, error) {
+    cmd := exec.Command(name, args...)
+    log.Debugln("command:", cmd.String())
+
+    var stdout, stderr bytes.Buffer
+    cmd.Stdout = &stdout
+    cmd.Stderr = &stderr
+    setProcessGroup(cmd)
+
+    if err := cmd.Start(); err != nil {
+        return nil, fmt.Errorf("%s failed: %v", cmd.String(), err)
+    }
+
+    done := make(chan error, 1)
+    go func() {
+        done <- cmd.Wait()
+    }()
+
+    select {
+    case err := <-done:
+        if err != nil {
+            msg := strings.TrimSpace(stderr.String())
+            if msg == "" {
+                msg = strings.TrimSpace(stdout.String())
+            }
+            return nil, fmt.Errorf("%s failed: %v: %s", cmd.String(), err, msg)
+        }
+        return stdout.Bytes(), nil
+
+    case <-ctx.Done():
+        if err := killProcessTree(cmd); err != nil {
+            log.Warnf("cannot kill %s (pid %d): %v", cmd.String(), cmd.Process.Pid, err)
+        }
+        // reap the child in the background so it does not linger as a
+        // zombie, a process in uninterruptible sleep, eg. when the GPU fell
+        // off the bus, only dies once its syscall returns
+        go func() {
+            <-done
+        }()
+        return nil, ctx.Err()
+    }
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+    "bufio"
+    "math"
+    "os/exec"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/common/log"
+)
+
+/**
+//===================================================
+//================ DMON / PMON STREAMS ==============
+//===================================================
+*/
+
+// dmonField is a `nvidia-smi dmon` or `pmon` column exported as min, max and
+// avg gauges. The column is only read when its unit, from the second header
+// line, is unit.
+type dmonField struct {
+    metric string
+    help   string
+    unit   string
+    scale  float64
+}
+
+// dmonFields are the columns of `dmon -s pucvmet` and `pmon -s um` by name.
+// Other columns, eg. of newer drivers, are ignored.
+var dmonFields = map[string]dmonField{
+    "pwr":   {metric: "power_draw_watts", help: "Power draw in watts.", unit: "W", scale: 1},
+    "gtemp": {metric: "temperature_gpu_celsius", help: "GPU core temperature in Celsius.", unit: "C", scale: 1},
+    "mtemp": {metric: "temperature_memory_celsius", help: "HBM memory temperature in Celsius.", unit: "C", scale: 1},
+    "sm":    {metric: "sm_utilization_ratio", help: "SM utilization from 0 to 1.", unit: "%", scale: 0.01},
+    "mem":   {metric: "memory_utilization_ratio", help: "Memory utilization from 0 to 1.", unit: "%", scale: 0.01},
+    "enc":   {metric: "encoder_utilization_ratio", help: "Encoder utilization from 0 to 1.", unit: "%", scale: 0.01},
+    "dec":   {metric: "decoder_utilization_ratio", help: "Decoder utilization from 0 to 1.", unit: "%", scale: 0.01},
+    "jpg":   {metric: "jpeg_utilization_ratio", help: "JPEG decoder utilization from 0 to 1.", unit: "%", scale: 0.01},
+    "ofa":   {metric: "ofa_utilization_ratio", help: "Optical flow accelerator utilization from 0 to 1.", unit: "%", scale: 0.01},
+    "mclk":  {metric: "clock_memory_mhz", help: "Memory clock in MHz.", unit: "MHz", scale: 1},
+    "pclk":  {metric: "clock_graphics_mhz", help: "Graphics (processor) clock in MHz.", unit: "MHz", scale: 1},
+    "pviol": {metric: "power_violation_ratio", help: "Time the clocks were capped by the power limit, from 0 to 1.", unit: "%", scale: 0.01},
+    "tviol": {metric: "thermal_violation", help: "Whether the clocks were capped by the thermal limit, 1 or 0.", unit: "bool", scale: 1},
+    "fb":    {metric: "memory_used_bytes", help: "Used frame buffer memory in bytes.", unit: "MB", scale: mebibyte},
+    "bar1":  {metric: "bar1_memory_used_bytes", help: "Used BAR1 memory in bytes.", unit: "MB", scale: mebibyte},
+    "ccpm":  {metric: "protected_memory_used_bytes", help: "Used confidential compute protected memory in bytes.", unit: "MB", scale: mebibyte},
+    "sbecc": {metric: "ecc_single_bit_errors", help: "Single bit ECC errors.", unit: "errs", scale: 1},
+    "dbecc": {metric: "ecc_double_bit_errors", help: "Double bit ECC errors.", unit: "errs", scale: 1},
+    "pci":   {metric: "pcie_replay_errors", help: "PCIe replay errors.", unit: "errs", scale: 1},
+    "rxpci": {metric: "pcie_rx_bytes_per_second", help: "PCIe receive throughput in bytes per second.", unit: "MB/s", scale: mebibyte},
+    "txpci": {metric: "pcie_tx_bytes_per_second", help: "PCIe transmit throughput in bytes per second.", unit: "MB/s", scale: mebibyte},
+}
+
+// dmonStats aggregates the samples of one column, already scaled.
+type dmonStats struct {
+    Min   float64
+    Max   float64
+    Sum   float64
+    Count int
+}
+
+func (s *dmonStats) add(v float64) {
+    if s.Count == 0 {
+        s.Min, s.Max = v, v
+    } else {
+        s.Min, s.Max = math.Min(s.Min, v), math.Max(s.Max, v)
+    }
+    s.Sum += v
+    s.Count++
+}
+
+// GPUSamples are the dmon and pmon samples of a GPU in the window, with the
+// stats of each column keyed by column name.
+type GPUSamples struct {
+    Count     int
+    Fields    map[string]*dmonStats
+    Processes map[string]*ProcessSamples
+}
+
+// ProcessSamples are the pmon samples of one process.
+type ProcessSamples struct {
+    PID         string
+    Type        string
+    ProcessName string
+    Fields      map[string]*dmonStats
+}
+
+// dmonTable tracks the header of a dmon or pmon stream. Both print
+//
+//  # gpu    pwr  gtemp  mtemp     sm ...
+//  # Idx      W      C      C      % ...
+//      0     62     31     38      0 ...
+//
+// and repeat the header every so many rows. A column without a reading is
+// printed as -.
+type dmonTable struct {
+    names []string
+    units []string
+}
+
+// parse returns the cells of a sample row, or nil for header and other
+// lines. The cells past the last column are joined into it, pmon command
+// names may contain spaces.
+func (t *dmonTable) parse(line string) []string {
+    if strings.HasPrefix(line, "#") {
+        cells := strings.Fields(strings.TrimPrefix(line, "#"))
+        if len(cells) > 0 && cells[0] == "gpu" {
+            t.names, t.units = cells, nil
+        } else if t.names != nil && t.units == nil && len(cells) == len(t.names) {
+            t.units = cells
+        }
+        return nil
+    }
+    cells := strings.Fields(line)
+    if t.units == nil || len(cells) < len(t.names) {
+        return nil
+    }
+    last := len(t.names) - 1
+    return append(cells[:last], strings.Join(cells[last:], " "))
+}
+
+// field returns the dmonField of column i, false when the column is unknown
+// or its unit is not the expected one.
+func (t *dmonTable) field(i int) (dmonField, bool) {
+    f, ok := dmonFields[t.names[i]]
+    return f, ok && t.units[i] == f.unit
+}
+
+// dmonSampler keeps `nvidia-smi dmon` and optionally `nvidia-smi pmon`
+// running and keeps their samples for a rolling window, so each query
+// reports the min, max and avg over the window instead of a single reading.
+// Queries do not consume samples, concurrent scrapers all see the same
+// window.
+type dmonSampler struct {
+    command string
+    delay   int
+    window  time.Duration
+    pmon    bool
+
+    mtx  sync.Mutex
+    dmon []dmonSample
+    // pmon samples, one per process row
+    processes []dmonSample
+}
+
+// dmonSample is a sample row with the scaled readings of its known columns.
+type dmonSample struct {
+    time   time.Time
+    gpu    int
+    values map[string]float64
+    // the process of a pmon row
+    pid, typ, name string
+}
+
+// dmon restarts are delayed from dmonMinBackoff, doubling up to
+// dmonMaxBackoff. A stream that ran for dmonMaxBackoff starts over.
+const (
+    dmonMinBackoff = time.Second
+    dmonMaxBackoff = time.Minute
+)
+
+func newDmonSampler(command string, delay int, window time.Duration, pmon bool) *dmonSampler {
+    if delay < 1 {
+        delay = 1
+    }
+    // at least one sample
+    if min := time.Duration(delay) * time.Second; window < min {
+        window = min
+    }
+    return &dmonSampler{
+        command: command,
+        delay:   delay,
+        window:  window,
+        pmon:    pmon,
+    }
+}
+
+// run starts the streams, they stop when stop is closed.
+func (s *dmonSampler) run(stop <-chan struct{}) {
+    d := strconv.Itoa(s.delay)
+    go s.stream(stop, s.addDmon, "dmon", "-s", "pucvmet", "-d", d)
+    if s.pmon {
+        go s.stream(stop, s.addPmon, "pmon", "-s", "um", "-d", d)
+    }
+}
+
+// stream runs the command with args until stop is closed, restarting it
+// with backoff whenever it exits.
+func (s *dmonSampler) stream(stop <-chan struct{}, add func(t *dmonTable, cells []string), args ...string) {
+    backoff := dmonMinBackoff
+    for {
+        started := time.Now()
+        err := s.follow(stop, add, args...)
+
+        select {
+        case <-stop:
+            return
+        default:
+        }
+        if time.Since(started) >= dmonMaxBackoff {
+            backoff = dmonMinBackoff
+        }
+        log.Warnf("%s %s exited, restarting in %s: %v", s.command, args[0], backoff, err)
+
+        select {
+        case <-time.After(backoff):
+        case <-stop:
+            return
+        }
+        if backoff *= 2; backoff > dmonMaxBackoff {
+            backoff = dmonMaxBackoff
+        }
+    }
+}
+
+// follow runs the command once and passes each sample row to add until it
+// exits or stop is closed.
+func (s *dmonSampler) follow(stop <-chan struct{}, add func(t *dmonTable, cells []string), args ...string) error {
+    cmd := exec.Command(s.command, args...)
+    log.Debugln("command:", cmd.String())
+    setProcessGroup(cmd)
+    stdout, err := cmd.StdoutPipe()
+    if err != nil {
+        return err
+    }
+    if err := cmd.Start(); err != nil {
+        return err
+    }
+
+    done := make(chan struct{})
+    defer close(done)
+    go func() {
+        select {
+        case <-stop:
+            if err := killProcessTree(cmd); err != nil {
+                log.Warnf("cannot kill %s (pid %d): %v", cmd.String(), cmd.Process.Pid, err)
+            }
+        case <-done:
+        }
+    }()
+
+    var table dmonTable
+    scanner := bufio.NewScanner(stdout)
+    for scanner.Scan() {
+        if cells := table.parse(scanner.Text()); cells != nil {
+            add(&table, cells)
+        }
+    }
+    if err := cmd.Wait(); err != nil {
+        return err
+    }
+    return scanner.Err()
+}
+
+// sampleValues returns the scaled readings of the known columns of cells.
+func sampleValues(t *dmonTable, cells []string) map[string]float64 {
+    values := map[string]float64{}
+    for i, cell := range cells {
+        f, ok := t.field(i)
+        if !ok || cell == "-" {
+            continue
+        }
+        v, err := strconv.ParseFloat(cell, 64)
+        if err != nil {
+            continue
+        }
+        values[t.names[i]] = v * f.scale
+    }
+    return values
+}
+
+// expire drops the samples before the window ending at now, samples are
+// in time order.
+func (s *dmonSampler) expire(samples []dmonSample, now time.Time) []dmonSample {
+    start := now.Add(-s.window)
+    i := 0
+    for i < len(samples) && !samples[i].time.After(start) {
+        i++
+    }
+    return samples[i:]
+}
+
+func (s *dmonSampler) addDmon(t *dmonTable, cells []string) {
+    index, err := strconv.Atoi(cells[0])
+    if err != nil {
+        return
+    }
+    now := time.Now()
+    sample := dmonSample{time: now, gpu: index, values: sampleValues(t, cells)}
+
+    s.mtx.Lock()
+    defer s.mtx.Unlock()
+    s.dmon = append(s.expire(s.dmon, now), sample)
+}
+
+// addPmon adds a pmon row, rows of GPUs without processes have pid -.
+func (s *dmonSampler) addPmon(t *dmonTable, cells []string) {
+    index, err := strconv.Atoi(cells[0])
+    if err != nil {
+        return
+    }
+    row := map[string]string{}
+    for i, name := range t.names {
+        row[name] = cells[i]
+    }
+    if row["pid"] == "" || row["pid"] == "-" {
+        return
+    }
+    now := time.Now()
+    sample := dmonSample{time: now, gpu: index, values: sampleValues(t, cells),
+        pid: row["pid"], typ: row["type"], name: row["command"]}
+
+    s.mtx.Lock()
+    defer s.mtx.Unlock()
+    s.processes = append(s.expire(s.processes, now), sample)
+}
+
+// stats returns the stats of the samples in the window ending at now,
+// keyed by GPU index.
+func (s *dmonSampler) stats(now time.Time) map[int]*GPUSamples {
+    s.mtx.Lock()
+    defer s.mtx.Unlock()
+    s.dmon = s.expire(s.dmon, now)
+    s.processes = s.expire(s.processes, now)
+
+    gpus := map[int]*GPUSamples{}
+    gpu := func(index int) *GPUSamples {
+        g, ok := gpus[index]
+        if !ok {
+            g = &GPUSamples{Fields: map[string]*dmonStats{}, Processes: map[string]*ProcessSamples{}}
+            gpus[index] = g
+        }
+        return g
+    }
+    for _, sample := range s.dmon {
+        g := gpu(sample.gpu)
+        g.Count++
+        addStats(g.Fields, sample.values)
+    }
+    for _, sample := range s.processes {
+        g := gpu(sample.gpu)
+        p, ok := g.Processes[sample.pid]
+        if !ok {
+            p = &ProcessSamples{PID: sample.pid, Type: sample.typ, ProcessName: sample.name, Fields: map[string]*dmonStats{}}
+            g.Processes[sample.pid] = p
+        }
+        addStats(p.Fields, sample.values)
+    }
+    return gpus
+}
+
+// addStats adds the readings of a sample to fields.
+func addStats(fields map[string]*dmonStats, values map[string]float64) {
+    for name, v := range values {
+        stats, ok := fields[name]
+        if !ok {
+            stats = &dmonStats{}
+            fields[name] = stats
+        }
+        stats.add(v)
+    }
+}
+
+// addSamples sets the Samples of each GPU, dmon and pmon only name GPUs by
+// index.
+func (l *NvidiaSmiLog) addSamples(gpus map[int]*GPUSamples) {
+    for index, s := range gpus {
+        if GPU := l.findGPU(gpuRef{index: index}); GPU != nil {
+            GPU.Samples = s
+        }
+    }
+}
+
+type dmonMetrics struct {
+    count   *prometheus.Desc
+    fields  map[string]*prometheus.Desc
+    process map[string]*prometheus.Desc
+}
+
+func newDmonMetrics(gpuLabels []string, pmon bool) *dmonMetrics {
+    m := &dmonMetrics{
+        count: newGPUDesc(gpuLabels,
+            "nvidia_dmon_samples",
+            "Number of nvidia-smi dmon samples in the window (--collector.dmon.window) aggregated by the nvidia_dmon_* metrics.",
+        ),
+        fields:  map[string]*prometheus.Desc{},
+        process: map[string]*prometheus.Desc{},
+    }
+    for name, f := range dmonFields {
+        m.fields[name] = newGPUDesc(gpuLabels,
+            "nvidia_dmon_"+f.metric,
+            f.help+" Min, max or avg of the nvidia-smi dmon samples in the window.",
+            "stat",
+        )
+    }
+    if !pmon {
+        return m
+    }
+    // pmon reports utilization and memory only
+    for _, name := range []string{"sm", "mem", "enc", "dec", "jpg", "ofa", "fb", "ccpm"} {
+        f := dmonFields[name]
+        m.process[name] = newGPUDesc(gpuLabels,
+            "nvidia_pmon_"+f.metric,
+            f.help+" Min, max or avg of the nvidia-smi pmon samples of a process in the window.",
+            "pid", "process_name", "type", "stat",
+        )
+    }
+    return m
+}
+
+func (m *dmonMetrics) describe(ch chan<- *prometheus.Desc) {
+    ch <- m.count
+    for _, desc := range m.fields {
+        ch <- desc
+    }
+    for _, desc := range m.process {
+        ch <- desc
+    }
+}
+
+func (m *dmonMetrics) collect(s gpuSink, gpu []string, GPU *NvidiaSmiGPU) {
+    samples := GPU.Samples
+    if samples == nil {
+        return
+    }
+    gauge(s.ch, m.count, float64(samples.Count), gpu...)
+    collectDmonStats(s.ch, m.fields, samples.Fields, gpu)
+    for _, p := range samples.Processes {
+        labels := append(append([]string{}, gpu...), p.PID, p.ProcessName, p.Type)
+        collectDmonStats(s.ch, m.process, p.Fields, labels)
+    }
+}
+
+// collectDmonStats sends the min, max and avg of each column with a desc.
+func collectDmonStats(ch chan<- prometheus.Metric, descs map[string]*prometheus.Desc, fields map[string]*dmonStats, labels []string) {
+    for name, stats := range fields {
+        desc, ok := descs[name]
+        if !ok || stats.Count == 0 {
+            continue
+        }
+        gauge(ch, desc, stats.Min, append(append([]string{}, labels...), "min")...)
+        gauge(ch, desc, stats.Max, append(append([]string{}, labels...), "max")...)
+        gauge(ch, desc, stats.Sum/float64(stats.Count), append(append([]string{}, labels...), "avg")...)
+    }
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+)
+
+// feedDmon passes the sample rows of a captured dmon or pmon output to add.
+func feedDmon(t *testing.T, file string, add func(t *dmonTable, cells []string)) {
+    var table dmonTable
+    for _, line := range strings.Split(string(readTestdata(t, file)), "\n") {
+        if cells := table.parse(line); cells != nil {
+            add(&table, cells)
+        }
+    }
+}
+
+func TestDmonTableParse(t *testing.T) {
+    var table dmonTable
+    tests := []struct {
+        line  string
+        cells []string
+    }{
+        // rows before the header are ignored
+        {"    0     62     31", nil},
+        {"# gpu         pid   type     sm   command ", nil},
+        // and so are rows before the units
+        {"    0      28459     C     80   python3", nil},
+        {"# Idx           #    C/G      %   name ", nil},
+        {"    0      28459     C     80   python3  ", []string{"0", "28459", "C", "80", "python3"}},
+        {"    0       1201   C+G     10   render worker", []string{"0", "1201", "C+G", "10", "render worker"}},
+        {"    0          -     -      -   -", []string{"0", "-", "-", "-", "-"}},
+        {"    0       1201   C+G", nil},
+        {"", nil},
+        // a new header replaces the columns
+        {"# gpu    pwr", nil},
+        {"# Idx      W", nil},
+        {"    1    301", []string{"1", "301"}},
+    }
+    for _, tt := range tests {
+        if cells := table.parse(tt.line); !reflect.DeepEqual(cells, tt.cells) {
+            t.Errorf("parse(%q) = %q, want %q", tt.line, cells, tt.cells)
+        }
+    }
+}
+
+func TestDmonSamples(t *testing.T) {
+    tests := []struct {
+        file  string
+        gpu   int
+        count int
+        field string
+        stats *dmonStats
+    }{
+        {"dmon.txt", 0, 3, "pwr", &dmonStats{Min: 62, Max: 80, Sum: 213, Count: 3}},
+        {"dmon.txt", 0, 3, "sm", &dmonStats{Min: 0.1, Max: 0.3, Sum: 0.6, Count: 3}},
+        {"dmon.txt", 0, 3, "fb", &dmonStats{Min: 512 * mebibyte, Max: 512 * mebibyte, Sum: 3 * 512 * mebibyte, Count: 3}},
+        {"dmon.txt", 1, 2, "pclk", &dmonStats{Min: 2520, Max: 2520, Sum: 5040, Count: 2}},
+        {"dmon.txt", 1, 2, "tviol", &dmonStats{Min: 0, Max: 1, Sum: 1, Count: 2}},
+        // - is skipped, not counted as 0
+        {"dmon.txt", 1, 2, "rxpci", &dmonStats{Min: 200 * mebibyte, Max: 200 * mebibyte, Sum: 200 * mebibyte, Count: 1}},
+        {"dmon.txt", 1, 2, "mtemp", nil},
+        {"dmon.txt", 1, 2, "sbecc", nil},
+        // older drivers report tviol in %, it is left out
+        {"dmon-old.txt", 0, 1, "tviol", nil},
+        {"dmon-old.txt", 0, 1, "pclk", &dmonStats{Min: 139, Max: 139, Sum: 139, Count: 1}},
+    }
+    for _, tt := range tests {
+        s := newDmonSampler("nvidia-smi", 1, time.Minute, false)
+        feedDmon(t, tt.file, s.addDmon)
+        g := s.stats(time.Now())[tt.gpu]
+        if g == nil {
+            t.Errorf("%s: no samples for GPU %d", tt.file, tt.gpu)
+            continue
+        }
+        if g.Count != tt.count {
+            t.Errorf("%s: GPU %d has %d samples, want %d", tt.file, tt.gpu, g.Count, tt.count)
+        }
+        got := g.Fields[tt.field]
+        if (got == nil) != (tt.stats == nil) || got != nil && !closeStats(*got, *tt.stats) {
+            t.Errorf("%s: GPU %d %s = %+v, want %+v", tt.file, tt.gpu, tt.field, got, tt.stats)
+        }
+    }
+}
+
+func TestPmonSamples(t *testing.T) {
+    s := newDmonSampler("nvidia-smi", 1, time.Minute, true)
+    feedDmon(t, "pmon.txt", s.addPmon)
+    gpus := s.stats(time.Now())
+
+    if g := gpus[0]; g != nil && len(g.Processes) != 0 {
+        t.Errorf("GPU 0 has processes %v, want none", g.Processes)
+    }
+    tests := []struct {
+        pid   string
+        typ   string
+        name  string
+        field string
+        stats *dmonStats
+    }{
+        {"28459", "C", "python3", "sm", &dmonStats{Min: 0.6, Max: 0.8, Sum: 1.4, Count: 2}},
+        {"28459", "C", "python3", "fb", &dmonStats{Min: 19000 * mebibyte, Max: 19100 * mebibyte, Sum: 38100 * mebibyte, Count: 2}},
+        {"28459", "C", "python3", "enc", nil},
+        {"1201", "C+G", "render worker", "enc", &dmonStats{Min: 0.05, Max: 0.05, Sum: 0.05, Count: 1}},
+    }
+    for _, tt := range tests {
+        p := gpus[1].Processes[tt.pid]
+        if p == nil {
+            t.Errorf("no samples for pid %s", tt.pid)
+            continue
+        }
+        if p.Type != tt.typ || p.ProcessName != tt.name {
+            t.Errorf("pid %s is %q %q, want %q %q", tt.pid, p.Type, p.ProcessName, tt.typ, tt.name)
+        }
+        got := p.Fields[tt.field]
+        if (got == nil) != (tt.stats == nil) || got != nil && !closeStats(*got, *tt.stats) {
+            t.Errorf("pid %s %s = %+v, want %+v", tt.pid, tt.field, got, tt.stats)
+        }
+    }
+}
+
+func TestDmonWindow(t *testing.T) {
+    s := newDmonSampler("nvidia-smi", 1, time.Minute, true)
+    feedDmon(t, "dmon.txt", s.addDmon)
+    feedDmon(t, "pmon.txt", s.addPmon)
+
+    // scrapes do not consume the samples
+    now := time.Now()
+    first := s.stats(now)
+    if second := s.stats(now); !reflect.DeepEqual(first, second) {
+        t.Errorf("second scrape got %v, want %v", second, first)
+    }
+    if g := first[0]; g == nil || g.Count != 3 {
+        t.Errorf("GPU 0 has %v, want 3 samples", g)
+    }
+
+    if gpus := s.stats(now.Add(time.Minute)); len(gpus) != 0 {
+        t.Errorf("samples older than the window = %v, want none", gpus)
+    }
+
+    // the window ends at the newest sample
+    feedDmon(t, "dmon-old.txt", s.addDmon)
+    gpus := s.stats(time.Now())
+    if len(gpus) != 1 || gpus[0].Count != 1 || len(gpus[0].Processes) != 0 {
+        t.Errorf("got %v, want the one sample of dmon-old.txt", gpus)
+    }
+}
+
+func TestDmonSamplerMinWindow(t *testing.T) {
+    if s := newDmonSampler("nvidia-smi", 5, time.Second, false); s.window != 5*time.Second {
+        t.Errorf("window %s, want the 5s delay", s.window)
+    }
+}
+
+// closeStats compares stats allowing for the rounding of scaled samples.
+func closeStats(a, b dmonStats) bool {
+    near := func(x, y float64) bool {
+        d := x - y
+        return d < 1e-9*(1+y) && -d < 1e-9*(1+y)
+    }
+    return a.Count == b.Count && near(a.Min, b.Min) && near(a.Max, b.Max) && near(a.Sum, b.Sum)
+}
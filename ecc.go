@@ -0,0 +1,115 @@
+package main
+
+import (
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+/**
+//===================================================
+//================ ECC ==============================
+//===================================================
+*/
+
+// EccMode is the <ecc_mode> section of a GPU.
+type EccMode struct {
+    Current string `xml:"current_ecc"`
+    Pending string `xml:"pending_ecc"`
+}
+
+// EccErrors is the <ecc_errors> section of a GPU. Volatile counts reset
+// with the driver, aggregate counts persist across reboots.
+type EccErrors struct {
+    Volatile EccErrorCounts `xml:"volatile"`
+    Aggregate EccErrorCounts `xml:"aggregate"`
+}
+
+// EccErrorCounts holds the counts of one scope. Older drivers break the
+// counts down by bit type and location, newer drivers only report
+// correctable and uncorrectable counts for SRAM and DRAM.
+type EccErrorCounts struct {
+    SingleBit EccLocations `xml:"single_bit"`
+    DoubleBit EccLocations `xml:"double_bit"`
+
+    SramCorrectable string `xml:"sram_correctable"`
+    SramUncorrectable string `xml:"sram_uncorrectable"`
+    DramCorrectable string `xml:"dram_correctable"`
+    DramUncorrectable string `xml:"dram_uncorrectable"`
+}
+
+// EccLocations are the error counts of one bit type by memory location.
+type EccLocations struct {
+    DeviceMemory string `xml:"device_memory"`
+    RegisterFile string `xml:"register_file"`
+    L1Cache string `xml:"l1_cache"`
+    L2Cache string `xml:"l2_cache"`
+    TextureMemory string `xml:"texture_memory"`
+    TextureShm string `xml:"texture_shm"`
+    Cbu string `xml:"cbu"`
+    Sram string `xml:"sram"`
+    Dram string `xml:"dram"`
+}
+
+type eccMetrics struct {
+    mode   *prometheus.Desc
+    errors *prometheus.Desc
+}
+
+func newEccMetrics(gpuLabels []string) *eccMetrics {
+    return &eccMetrics{
+        mode: newGPUDesc(gpuLabels,
+            "nvidia_ecc_mode",
+            "Whether ECC is enabled (1) or disabled (0). state is current, or pending for the mode after the next reboot.",
+            "state",
+        ),
+        errors: newGPUDesc(gpuLabels,
+            "nvidia_ecc_errors_total",
+            "ECC errors by scope (volatile since the last driver load, aggregate over the GPU lifetime), bit type (single is correctable, double is uncorrectable) and memory location.",
+            "scope", "bit", "location",
+        ),
+    }
+}
+
+func (m *eccMetrics) describe(ch chan<- *prometheus.Desc) {
+    ch <- m.mode
+    ch <- m.errors
+}
+
+func (m *eccMetrics) collect(s gpuSink, gpu []string, GPU *NvidiaSmiGPU) {
+    s.gpuFlag(m.mode, gpu, "ecc_mode.current_ecc", GPU.EccMode.Current, "current")
+    s.gpuFlag(m.mode, gpu, "ecc_mode.pending_ecc", GPU.EccMode.Pending, "pending")
+
+    m.collectScope(s, gpu, "volatile", &GPU.EccErrors.Volatile)
+    m.collectScope(s, gpu, "aggregate", &GPU.EccErrors.Aggregate)
+}
+
+func (m *eccMetrics) collectScope(s gpuSink, gpu []string, scope string, counts *EccErrorCounts) {
+    m.collectLocations(s, gpu, scope, "single", &counts.SingleBit)
+    m.collectLocations(s, gpu, scope, "double", &counts.DoubleBit)
+
+    field := "ecc_errors." + scope + "."
+    s.gpuCounter(m.errors, gpu, field+"sram_correctable", counts.SramCorrectable, scope, "single", "sram")
+    s.gpuCounter(m.errors, gpu, field+"sram_uncorrectable", counts.SramUncorrectable, scope, "double", "sram")
+    s.gpuCounter(m.errors, gpu, field+"dram_correctable", counts.DramCorrectable, scope, "single", "dram")
+    s.gpuCounter(m.errors, gpu, field+"dram_uncorrectable", counts.DramUncorrectable, scope, "double", "dram")
+}
+
+func (m *eccMetrics) collectLocations(s gpuSink, gpu []string, scope string, bit string, l *EccLocations) {
+    field := "ecc_errors." + scope + "." + bit + "_bit."
+    locations := []struct {
+        name  string
+        value string
+    }{
+        {"device_memory", l.DeviceMemory},
+        {"register_file", l.RegisterFile},
+        {"l1_cache", l.L1Cache},
+        {"l2_cache", l.L2Cache},
+        {"texture_memory", l.TextureMemory},
+        {"texture_shm", l.TextureShm},
+        {"cbu", l.Cbu},
+        {"sram", l.Sram},
+        {"dram", l.Dram},
+    }
+    for _, loc := range locations {
+        s.gpuCounter(m.errors, gpu, field+loc.name, loc.value, scope, bit, loc.name)
+    }
+}
@@ -0,0 +1,13 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestEccMetrics(t *testing.T) {
+    // q-x-470.xml counts per location, q-x-535.xml per sram and dram
+    for _, dump := range testDumps {
+        c := newDumpCollector(t, dump, CollectorOpts{})
+        testGolden(t, c, goldenName(dump, "ecc"), "nvidia_ecc_mode", "nvidia_ecc_errors_total")
+    }
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+    "context"
+    "strconv"
+    "strings"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/common/log"
+)
+
+/**
+//===================================================
+//================ ENCODER / FBC SESSIONS ===========
+//===================================================
+*/
+
+// SessionStats is the <encoder_stats> or <fbc_stats> (frame buffer
+// capture) section of a GPU. average_latency is in microseconds.
+type SessionStats struct {
+    SessionCount string `xml:"session_count"`
+    AverageFps string `xml:"average_fps"`
+    AverageLatency string `xml:"average_latency"`
+}
+
+// EncoderSession is a row of `nvidia-smi encodersessions`.
+type EncoderSession struct {
+    SessionID string
+    PID string
+    Codec string
+    HRes string
+    VRes string
+    AverageFps string
+    AverageLatency string
+}
+
+// queryEncoderSessions runs `nvidia-smi encodersessions` and returns the
+// active sessions keyed by GPU index.
+func queryEncoderSessions(ctx context.Context, command string) (map[int][]EncoderSession, error) {
+    out, err := runCommand(ctx, command, "encodersessions")
+    if err != nil {
+        return nil, err
+    }
+    return parseEncoderSessions(out), nil
+}
+
+// parseEncoderSessions parses the session rows of `nvidia-smi encodersessions`.
+//
+//  # GPU  Session   Process   Codec      H       V  Average  Average
+//  # Idx       Id        Id    Type    Res     Res      FPS  Latency(us)
+//      0        1     28459   H.264   1920    1080       29     1234
+//
+// A GPU without sessions has a row of dashes.
+func parseEncoderSessions(out []byte) map[int][]EncoderSession {
+    sessions := map[int][]EncoderSession{}
+    for _, line := range strings.Split(string(out), "\n") {
+        f := strings.Fields(line)
+        if len(f) != 8 || strings.HasPrefix(f[0], "#") || f[1] == "-" {
+            continue
+        }
+        index, err := strconv.Atoi(f[0])
+        if err != nil {
+            continue
+        }
+        sessions[index] = append(sessions[index], EncoderSession{
+            SessionID:      f[1],
+            PID:            f[2],
+            Codec:          f[3],
+            HRes:           f[4],
+            VRes:           f[5],
+            AverageFps:     f[6],
+            AverageLatency: f[7],
+        })
+    }
+    return sessions
+}
+
+// addEncoderSessions fills the EncoderSessions of each GPU.
+func (l *NvidiaSmiLog) addEncoderSessions(ctx context.Context, command string) {
+    sessions, err := queryEncoderSessions(ctx, command)
+    if err != nil {
+        log.Warnf("cannot list encoder sessions: %v", err)
+        return
+    }
+    l.setEncoderSessions(sessions)
+}
+
+// setEncoderSessions sets the EncoderSessions of each GPU, encodersessions
+// only names GPUs by index.
+func (l *NvidiaSmiLog) setEncoderSessions(sessions map[int][]EncoderSession) {
+    for index, s := range sessions {
+        if GPU := l.findGPU(gpuRef{index: index}); GPU != nil {
+            GPU.EncoderSessions = s
+        }
+    }
+}
+
+// microseconds to seconds
+const microsecond = 1e-6
+
+type encoderMetrics struct {
+    encoderSessions *prometheus.Desc
+    encoderFps      *prometheus.Desc
+    encoderLatency  *prometheus.Desc
+    fbcSessions     *prometheus.Desc
+    fbcFps          *prometheus.Desc
+    fbcLatency      *prometheus.Desc
+    sessionFps      *prometheus.Desc
+    sessionLatency  *prometheus.Desc
+}
+
+func newEncoderMetrics(gpuLabels []string) *encoderMetrics {
+    sessionLabels := []string{"session_id", "pid", "codec", "resolution"}
+    return &encoderMetrics{
+        encoderSessions: newGPUDesc(gpuLabels,
+            "nvidia_encoder_session_count",
+            "Number of active encoder sessions.",
+        ),
+        encoderFps: newGPUDesc(gpuLabels,
+            "nvidia_encoder_average_fps",
+            "Average frames per second over all active encoder sessions.",
+        ),
+        encoderLatency: newGPUDesc(gpuLabels,
+            "nvidia_encoder_average_latency_seconds",
+            "Average encode latency over all active encoder sessions in seconds.",
+        ),
+        fbcSessions: newGPUDesc(gpuLabels,
+            "nvidia_fbc_session_count",
+            "Number of active frame buffer capture sessions.",
+        ),
+        fbcFps: newGPUDesc(gpuLabels,
+            "nvidia_fbc_average_fps",
+            "Average frames per second over all active frame buffer capture sessions.",
+        ),
+        fbcLatency: newGPUDesc(gpuLabels,
+            "nvidia_fbc_average_latency_seconds",
+            "Average capture latency over all active frame buffer capture sessions in seconds.",
+        ),
+        sessionFps: newGPUDesc(gpuLabels,
+            "nvidia_encoder_session_average_fps",
+            "Average frames per second of an encoder session, with --collector.encoder-sessions.",
+            sessionLabels...,
+        ),
+        sessionLatency: newGPUDesc(gpuLabels,
+            "nvidia_encoder_session_average_latency_seconds",
+            "Average encode latency of an encoder session in seconds, with --collector.encoder-sessions.",
+            sessionLabels...,
+        ),
+    }
+}
+
+func (m *encoderMetrics) describe(ch chan<- *prometheus.Desc) {
+    ch <- m.encoderSessions
+    ch <- m.encoderFps
+    ch <- m.encoderLatency
+    ch <- m.fbcSessions
+    ch <- m.fbcFps
+    ch <- m.fbcLatency
+    ch <- m.sessionFps
+    ch <- m.sessionLatency
+}
+
+func (m *encoderMetrics) collect(s gpuSink, gpu []string, GPU *NvidiaSmiGPU) {
+    enc := &GPU.EncoderStats
+    s.gpuGauge(m.encoderSessions, gpu, "encoder_stats.session_count", enc.SessionCount, 1)
+    s.gpuGauge(m.encoderFps, gpu, "encoder_stats.average_fps", enc.AverageFps, 1)
+    s.gpuGauge(m.encoderLatency, gpu, "encoder_stats.average_latency", enc.AverageLatency, microsecond)
+
+    fbc := &GPU.FbcStats
+    s.gpuGauge(m.fbcSessions, gpu, "fbc_stats.session_count", fbc.SessionCount, 1)
+    s.gpuGauge(m.fbcFps, gpu, "fbc_stats.average_fps", fbc.AverageFps, 1)
+    s.gpuGauge(m.fbcLatency, gpu, "fbc_stats.average_latency", fbc.AverageLatency, microsecond)
+
+    for _, session := range GPU.EncoderSessions {
+        resolution := session.HRes + "x" + session.VRes
+        s.gpuGauge(m.sessionFps, gpu, "encodersessions.average_fps", session.AverageFps, 1, session.SessionID, session.PID, session.Codec, resolution)
+        s.gpuGauge(m.sessionLatency, gpu, "encodersessions.average_latency", session.AverageLatency, microsecond, session.SessionID, session.PID, session.Codec, resolution)
+    }
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+    "reflect"
+    "testing"
+)
+
+func TestParseEncoderSessions(t *testing.T) {
+    session := EncoderSession{SessionID: "1", PID: "1201", Codec: "H.264", HRes: "1920", VRes: "1080", AverageFps: "29", AverageLatency: "1234"}
+    tests := []struct {
+        out  string
+        want map[int][]EncoderSession
+    }{
+        {string(readTestdata(t, "encodersessions.txt")), map[int][]EncoderSession{1: {session}}},
+        {`# GPU  Session   Process   Codec      H       V  Average  Average
+# Idx       Id        Id    Type    Res     Res      FPS  Latency(us)
+    0        1      1201    H.264   1920    1080       29     1234
+    0        2      1201     HEVC   3840    2160       59     2210
+`, map[int][]EncoderSession{0: {session, {SessionID: "2", PID: "1201", Codec: "HEVC", HRes: "3840", VRes: "2160", AverageFps: "59", AverageLatency: "2210"}}}},
+        // rows of dashes, truncated rows and the header are skipped
+        {`# GPU  Session   Process   Codec      H       V  Average  Average
+    0        -         -        -      -       -        -      -
+    0        1      1201    H.264   1920    1080
+`, map[int][]EncoderSession{}},
+        {"No devices were found\n", map[int][]EncoderSession{}},
+        {"", map[int][]EncoderSession{}},
+    }
+    for _, tt := range tests {
+        if got := parseEncoderSessions([]byte(tt.out)); !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("parseEncoderSessions(%q) = %+v, want %+v", tt.out, got, tt.want)
+        }
+    }
+}
+
+func TestEncoderMetrics(t *testing.T) {
+    for _, dump := range testDumps {
+        c := newDumpCollector(t, dump, CollectorOpts{})
+        // the RTX 4090 of q-x-535.xml has an encoder session
+        if dump == "q-x-535.xml" {
+            c.source.(*dumpSource).log.setEncoderSessions(parseEncoderSessions(readTestdata(t, "encodersessions.txt")))
+        }
+        testGolden(t, c, goldenName(dump, "encoder"),
+            "nvidia_encoder_session_count",
+            "nvidia_encoder_average_fps",
+            "nvidia_encoder_average_latency_seconds",
+            "nvidia_fbc_session_count",
+            "nvidia_fbc_average_fps",
+            "nvidia_fbc_average_latency_seconds",
+            "nvidia_encoder_session_average_fps",
+            "nvidia_encoder_session_average_latency_seconds",
+        )
+    }
+}
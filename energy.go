@@ -0,0 +1,196 @@
+package main
+
+import (
+    "encoding/json"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/common/log"
+)
+
+/**
+//===================================================
+//================ ENERGY ===========================
+//===================================================
+*/
+
+// energyMaxGap is the longest gap between two power samples that is
+// integrated. Longer gaps, eg. while the exporter was stopped, are skipped
+// so the counter does not guess the energy used in between.
+const energyMaxGap = 2 * time.Minute
+
+// energyMeter keeps a per-GPU energy counter in joules, keyed by GPU UUID.
+// It adds the increase of total_energy_consumption when the driver reports
+// it and otherwise integrates power draw between samples. The counters are
+// saved to a state file so they survive exporter restarts.
+type energyMeter struct {
+    mtx   sync.Mutex
+    path  string
+    state map[string]*energyState
+}
+
+// energyState is the persisted state of one GPU.
+type energyState struct {
+    Joules float64 `json:"joules"`
+    // last driver counter reading in joules, when the driver reports one
+    DriverJoules *float64 `json:"driver_joules,omitempty"`
+    // last power draw sample
+    Watts  float64   `json:"watts"`
+    Sample time.Time `json:"sample"`
+}
+
+// newEnergyMeter creates a meter saving to path, "" keeps it in memory only.
+func newEnergyMeter(path string) *energyMeter {
+    m := &energyMeter{
+        path:  path,
+        state: map[string]*energyState{},
+    }
+    if path == "" {
+        return m
+    }
+
+    data, err := ioutil.ReadFile(path)
+    if os.IsNotExist(err) {
+        return m
+    }
+    if err == nil {
+        err = json.Unmarshal(data, &m.state)
+    }
+    if err != nil {
+        log.Warnf("cannot load energy state %s, starting from 0: %v", path, err)
+        m.state = map[string]*energyState{}
+    }
+    return m
+}
+
+// observe adds the energy used by each GPU since the previous snapshot,
+// taken by the source at now. Queries overlap, a snapshot that is not
+// newer than the last one observed for a GPU is ignored.
+func (m *energyMeter) observe(xmlData *NvidiaSmiLog, now time.Time) {
+    m.mtx.Lock()
+    defer m.mtx.Unlock()
+
+    for i := range xmlData.GPUs {
+        GPU := &xmlData.GPUs[i]
+        if GPU.UUID == "" {
+            continue
+        }
+        s, ok := m.state[GPU.UUID]
+        if !ok {
+            s = &energyState{}
+            m.state[GPU.UUID] = s
+        }
+        if !now.After(s.Sample) {
+            continue
+        }
+
+        if total := parseEnergy(GPU.TotalEnergyConsumption); total.ok() {
+            // the driver counter restarts from 0 when the driver reloads
+            if s.DriverJoules != nil && total.Value >= *s.DriverJoules {
+                s.Joules += total.Value - *s.DriverJoules
+            } else if s.DriverJoules != nil {
+                s.Joules += total.Value
+            }
+            s.DriverJoules = &total.Value
+            s.Sample = now
+            continue
+        }
+        // the last power sample is stale when the driver counter was used
+        fromCounter := s.DriverJoules != nil
+        s.DriverJoules = nil
+
+        _, board := GPU.boardPower()
+        _, draw := board.draw()
+        watts := parseValue(draw)
+        if !watts.ok() {
+            continue
+        }
+        if dt := now.Sub(s.Sample); !s.Sample.IsZero() && !fromCounter && dt <= energyMaxGap {
+            // trapezoid between the previous and this sample
+            s.Joules += (s.Watts + watts.Value) / 2 * dt.Seconds()
+        }
+        s.Watts = watts.Value
+        s.Sample = now
+    }
+
+    if err := m.save(); err != nil {
+        log.Warnf("cannot save energy state %s: %v", m.path, err)
+    }
+}
+
+// joules returns the counter of a GPU.
+func (m *energyMeter) joules(uuid string) (float64, bool) {
+    m.mtx.Lock()
+    defer m.mtx.Unlock()
+    s, ok := m.state[uuid]
+    if !ok {
+        return 0, false
+    }
+    return s.Joules, true
+}
+
+// save writes the state file, via a temporary file so a crash never
+// leaves a truncated state behind. The caller holds m.mtx.
+func (m *energyMeter) save() error {
+    if m.path == "" {
+        return nil
+    }
+    data, err := json.Marshal(m.state)
+    if err != nil {
+        return err
+    }
+    tmp, err := ioutil.TempFile(filepath.Dir(m.path), filepath.Base(m.path)+".tmp")
+    if err != nil {
+        return err
+    }
+    if _, err := tmp.Write(data); err != nil {
+        tmp.Close()
+        os.Remove(tmp.Name())
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        os.Remove(tmp.Name())
+        return err
+    }
+    return os.Rename(tmp.Name(), m.path)
+}
+
+// parseEnergy parses total_energy_consumption as joules. NVML reports
+// millijoules, a reading with an explicit J unit is taken as joules.
+func parseEnergy(raw string) smiValue {
+    v := parseValue(raw)
+    if v.ok() && !strings.HasSuffix(strings.TrimSpace(raw), " J") {
+        v.Value = v.Value / 1000
+    }
+    return v
+}
+
+type energyMetrics struct {
+    meter  *energyMeter
+    energy *prometheus.Desc
+}
+
+func newEnergyMetrics(gpuLabels []string, meter *energyMeter) *energyMetrics {
+    return &energyMetrics{
+        meter: meter,
+        energy: newGPUDesc(gpuLabels,
+            "nvidia_energy_joules_total",
+            "Energy used by the GPU in joules since the exporter first saw it, from the driver energy counter or integrated from power draw samples.",
+        ),
+    }
+}
+
+func (m *energyMetrics) describe(ch chan<- *prometheus.Desc) {
+    ch <- m.energy
+}
+
+func (m *energyMetrics) collect(s gpuSink, gpu []string, GPU *NvidiaSmiGPU) {
+    if joules, ok := m.meter.joules(GPU.UUID); ok {
+        s.ch <- prometheus.MustNewConstMetric(m.energy, prometheus.CounterValue, joules, gpu...)
+    }
+}
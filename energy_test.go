@@ -0,0 +1,95 @@
+package main
+
+import (
+    "io/ioutil"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+// powerSnapshot is a snapshot of one GPU drawing watts, or reporting the
+// driver energy counter when total is set.
+func powerSnapshot(watts string, total string) *NvidiaSmiLog {
+    return &NvidiaSmiLog{GPUs: []NvidiaSmiGPU{{
+        UUID:                   testUUID0,
+        PowerReadings:          PowerReadings{PowerDraw: watts},
+        TotalEnergyConsumption: total,
+    }}}
+}
+
+func TestEnergyMeter(t *testing.T) {
+    start := time.Date(2023, 11, 14, 9, 0, 0, 0, time.UTC)
+    type sample struct {
+        after time.Duration
+        watts string
+        total string
+    }
+    tests := []struct {
+        name    string
+        samples []sample
+        joules  float64
+    }{
+        {"trapezoid", []sample{{0, "100.00 W", ""}, {10 * time.Second, "200.00 W", ""}}, 1500},
+        {"first sample", []sample{{0, "100.00 W", ""}}, 0},
+        {"N/A is skipped", []sample{{0, "100.00 W", ""}, {10 * time.Second, "[N/A]", ""}, {20 * time.Second, "100.00 W", ""}}, 2000},
+        {"gap over energyMaxGap", []sample{{0, "100.00 W", ""}, {energyMaxGap + time.Second, "100.00 W", ""}, {energyMaxGap + 11*time.Second, "100.00 W", ""}}, 1000},
+        {"gap of energyMaxGap", []sample{{0, "100.00 W", ""}, {energyMaxGap, "100.00 W", ""}}, 100 * energyMaxGap.Seconds()},
+        // an older overlapping query finishing last
+        {"older snapshot", []sample{{0, "100.00 W", ""}, {10 * time.Second, "100.00 W", ""}, {5 * time.Second, "300.00 W", ""}, {20 * time.Second, "100.00 W", ""}}, 2000},
+        {"same snapshot", []sample{{0, "100.00 W", ""}, {10 * time.Second, "100.00 W", ""}, {10 * time.Second, "100.00 W", ""}}, 1000},
+        // the driver counter is in mJ
+        {"driver counter", []sample{{0, "", "1000000"}, {10 * time.Second, "", "1500000"}, {20 * time.Second, "", "1700000"}}, 700},
+        {"driver counter reset", []sample{{0, "", "1000000"}, {10 * time.Second, "", "1500000"}, {20 * time.Second, "", "200000"}, {30 * time.Second, "", "300000"}}, 800},
+        {"driver counter older snapshot", []sample{{0, "", "1000000"}, {10 * time.Second, "", "1500000"}, {5 * time.Second, "", "1200000"}, {20 * time.Second, "", "1600000"}}, 600},
+        {"driver counter in J", []sample{{0, "", "1000 J"}, {10 * time.Second, "", "1500 J"}}, 500},
+        // power draw is integrated from the first sample after the counter is gone
+        {"driver counter gone", []sample{{0, "100.00 W", "1000000"}, {10 * time.Second, "100.00 W", "[N/A]"}, {20 * time.Second, "100.00 W", "[N/A]"}}, 1000},
+    }
+    for _, tt := range tests {
+        m := newEnergyMeter("")
+        for _, s := range tt.samples {
+            m.observe(powerSnapshot(s.watts, s.total), start.Add(s.after))
+        }
+        joules, _ := m.joules(testUUID0)
+        if joules != tt.joules {
+            t.Errorf("%s: %v J, want %v J", tt.name, joules, tt.joules)
+        }
+    }
+}
+
+func TestEnergyMeterState(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "energy.json")
+    start := time.Date(2023, 11, 14, 9, 0, 0, 0, time.UTC)
+
+    m := newEnergyMeter(path)
+    m.observe(powerSnapshot("100.00 W", ""), start)
+    m.observe(powerSnapshot("100.00 W", ""), start.Add(10*time.Second))
+
+    // a restarted exporter continues the counter and the integration
+    m = newEnergyMeter(path)
+    if joules, ok := m.joules(testUUID0); !ok || joules != 1000 {
+        t.Errorf("restored %v J %v, want 1000 J", joules, ok)
+    }
+    m.observe(powerSnapshot("100.00 W", ""), start.Add(20*time.Second))
+    if joules, _ := m.joules(testUUID0); joules != 2000 {
+        t.Errorf("after restore %v J, want 2000 J", joules)
+    }
+    if _, ok := m.joules(testUUID1); ok {
+        t.Errorf("counter for a GPU never seen")
+    }
+}
+
+func TestEnergyMeterBadState(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "energy.json")
+    if err := ioutil.WriteFile(path, []byte("{\"GPU-"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    m := newEnergyMeter(path)
+    if _, ok := m.joules(testUUID0); ok {
+        t.Errorf("counter from a truncated state file")
+    }
+    m.observe(powerSnapshot("100.00 W", ""), time.Now())
+    if m = newEnergyMeter(path); len(m.state) != 1 {
+        t.Errorf("state file not rewritten, %d GPUs", len(m.state))
+    }
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+    "strconv"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+/**
+//===================================================
+//================ FANS =============================
+//===================================================
+*/
+
+// Fan is a single fan of the board. The -q -x dump and --query-gpu only
+// have the board fan speed, so only the nvml source fills in the fans.
+type Fan struct {
+    Speed       string
+    TargetSpeed string
+}
+
+type fanMetrics struct {
+    fanSpeed    *prometheus.Desc
+    speed       *prometheus.Desc
+    targetSpeed *prometheus.Desc
+}
+
+func newFanMetrics(gpuLabels []string) *fanMetrics {
+    return &fanMetrics{
+        fanSpeed: newGPUDesc(gpuLabels,
+            "nvidia_fanspeed_ratio",
+            "The fan speed value is the percent of maximum speed from 0 to 1 that the device's fan is currently intended to run at",
+        ),
+        speed: newGPUDesc(gpuLabels,
+            "nvidia_fan_speed_ratio",
+            "Speed of each fan from 0 to 1 of its maximum speed, the speed the fan is intended to run at. A fan that fails to reach it is not detected. Only exported by the nvml source, which reads each fan.",
+            "fan",
+        ),
+        targetSpeed: newGPUDesc(gpuLabels,
+            "nvidia_fan_target_speed_ratio",
+            "Target speed of each fan from 0 to 1 of its maximum speed, as requested by the driver or fan control. Only exported by the nvml source, which reads each fan.",
+            "fan",
+        ),
+    }
+}
+
+func (m *fanMetrics) describe(ch chan<- *prometheus.Desc) {
+    ch <- m.fanSpeed
+    ch <- m.speed
+    ch <- m.targetSpeed
+}
+
+func (m *fanMetrics) collect(s gpuSink, gpu []string, GPU *NvidiaSmiGPU) {
+    s.gpuGauge(m.fanSpeed, gpu, "fan_speed", GPU.FanSpeed, 0.01)
+    for i, fan := range GPU.Fans {
+        s.gpuGauge(m.speed, gpu, "fans.speed", fan.Speed, 0.01, strconv.Itoa(i))
+        s.gpuGauge(m.targetSpeed, gpu, "fans.target_speed", fan.TargetSpeed, 0.01, strconv.Itoa(i))
+    }
+}
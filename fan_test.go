@@ -0,0 +1,21 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestFanMetrics(t *testing.T) {
+    for _, dump := range testDumps {
+        c := newDumpCollector(t, dump, CollectorOpts{})
+        testGolden(t, c, goldenName(dump, "fan"), "nvidia_fanspeed_ratio", "nvidia_fan_speed_ratio", "nvidia_fan_target_speed_ratio")
+    }
+
+    // the nvml source adds the fans of the board, the board speed is not
+    // reported as one of them
+    c := newDumpCollector(t, "q-x-535.xml", CollectorOpts{})
+    c.source.(*dumpSource).log.GPUs[1].Fans = []Fan{
+        {Speed: "30 %", TargetSpeed: "30 %"},
+        {Speed: "32 %", TargetSpeed: "[Not Supported]"},
+    }
+    testGolden(t, c, "q-x-535.fans.prom", "nvidia_fanspeed_ratio", "nvidia_fan_speed_ratio", "nvidia_fan_target_speed_ratio")
+}
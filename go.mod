@@ -1,10 +1,25 @@
 module github.com/scottmcdonnell/nvidia_smi_exporter
 
-go 1.15
+go 1.20
 
 require (
+	github.com/NVIDIA/go-nvml v0.12.4-0
 	github.com/prometheus/client_golang v1.8.0
 	github.com/prometheus/common v0.15.0
 	golang.org/x/sys v0.0.0-20201112073958-5cba982894dd
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
 )
+
+require (
+	github.com/alecthomas/template v0.0.0-20190718012654-fb15b899a751 // indirect
+	github.com/alecthomas/units v0.0.0-20190924025748-f65c72e2690d // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.1 // indirect
+	github.com/golang/protobuf v1.4.3 // indirect
+	github.com/konsorten/go-windows-terminal-sequences v1.0.3 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/client_model v0.2.0 // indirect
+	github.com/prometheus/procfs v0.2.0 // indirect
+	github.com/sirupsen/logrus v1.6.0 // indirect
+	google.golang.org/protobuf v1.23.0 // indirect
+)
@@ -0,0 +1,126 @@
+package main
+
+import (
+    "fmt"
+    "strconv"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+/**
+//===================================================
+//================ GPU IDENTITY LABELS ==============
+//===================================================
+*/
+
+// gpuIdentityLabels are the labels that can identify a GPU on per-GPU series.
+// gpu is the position in the nvidia-smi output, which changes when a card
+// drops off the bus or the devices are reordered. The others stay attached
+// to the physical device.
+var gpuIdentityLabels = []string{"gpu", "uuid", "pci_bus_id", "minor_number", "serial"}
+
+var defaultGPULabels = []string{"gpu"}
+
+// uniqueGPULabels are the identity labels that differ for every GPU of a
+// host. serial and minor_number are N/A on some boards and platforms, eg.
+// serial on GeForce cards and minor_number on Windows.
+var uniqueGPULabels = []string{"gpu", "uuid", "pci_bus_id"}
+
+// validateGPULabels checks labels only holds known identity labels and at
+// least one that is unique per GPU.
+func validateGPULabels(labels []string) error {
+    if len(labels) == 0 {
+        return fmt.Errorf("at least one GPU label is required, choose from %v", gpuIdentityLabels)
+    }
+    seen := map[string]bool{}
+    for _, l := range labels {
+        if !isGPUIdentityLabel(l) {
+            return fmt.Errorf("unknown GPU label %q, choose from %v", l, gpuIdentityLabels)
+        }
+        if seen[l] {
+            return fmt.Errorf("duplicate GPU label %q", l)
+        }
+        seen[l] = true
+    }
+    for _, l := range uniqueGPULabels {
+        if seen[l] {
+            return nil
+        }
+    }
+    return fmt.Errorf("serial and minor_number can be N/A on several GPUs, add one of %v", uniqueGPULabels)
+}
+
+func isGPUIdentityLabel(label string) bool {
+    for _, l := range gpuIdentityLabels {
+        if l == label {
+            return true
+        }
+    }
+    return false
+}
+
+// infoGPULabels returns labels followed by the identity labels it lacks.
+func infoGPULabels(labels []string) []string {
+    result := append([]string{}, labels...)
+    for _, l := range gpuIdentityLabels {
+        found := false
+        for _, have := range labels {
+            found = found || have == l
+        }
+        if !found {
+            result = append(result, l)
+        }
+    }
+    return result
+}
+
+// gpuLabelValues returns the values of labels for the GPU at index.
+func gpuLabelValues(labels []string, index int, gpu *NvidiaSmiGPU) []string {
+    values := make([]string, 0, len(labels))
+    for _, l := range labels {
+        switch l {
+        case "gpu":
+            values = append(values, strconv.Itoa(index))
+        case "uuid":
+            values = append(values, gpu.UUID)
+        case "pci_bus_id":
+            values = append(values, gpu.PCI.PCIBusID)
+        case "minor_number":
+            values = append(values, gpu.MinorNumber)
+        case "serial":
+            values = append(values, gpu.Serial)
+        }
+    }
+    return values
+}
+
+// gpuRef names a GPU in the text output of an nvidia-smi subcommand, by
+// index and, when the output prints it, by UUID.
+type gpuRef struct {
+    index int
+    uuid  string
+}
+
+// findGPU returns the GPU of the snapshot ref names, nil when there is none.
+// The UUID is preferred. Without it the index is matched to the position in
+// the -q -x dump, nvidia-smi numbers GPUs in that order, but like the gpu
+// label it shifts when a GPU falls off the bus between the two commands.
+func (l *NvidiaSmiLog) findGPU(ref gpuRef) *NvidiaSmiGPU {
+    if ref.uuid != "" {
+        for i := range l.GPUs {
+            if l.GPUs[i].UUID == ref.uuid {
+                return &l.GPUs[i]
+            }
+        }
+        return nil
+    }
+    if ref.index < 0 || ref.index >= len(l.GPUs) {
+        return nil
+    }
+    return &l.GPUs[ref.index]
+}
+
+// newGPUDesc creates a desc labelled by the GPU labels followed by labels.
+func newGPUDesc(gpuLabels []string, name string, help string, labels ...string) *prometheus.Desc {
+    return prometheus.NewDesc(name, help, append(append([]string{}, gpuLabels...), labels...), nil)
+}
@@ -1,17 +1,15 @@
-// +build windows
-
 package main
 
 import (
     "fmt"
     "net/http"
     "strconv"
+    "strings"
+    "time"
     //"path/filepath"
     "os"
     "os/exec"
 
-    "golang.org/x/sys/windows/svc"
-
     "github.com/prometheus/common/log"
     "github.com/prometheus/client_golang/prometheus"
     "github.com/prometheus/client_golang/prometheus/promhttp"
@@ -42,6 +40,11 @@ var (
         "Command line flags for the command app",
     ).Default(COMMAND_FLAGS).String()
 
+    source = kingpin.Flag(
+        "collector.source",
+        "Where GPU readings come from: xml (nvidia-smi -q -x, every metric), csv (nvidia-smi --query-gpu, cheaper but fewer metrics) or nvml (the NVML library, Linux only, no nvidia-smi process per scrape).",
+    ).Default("xml").Enum("xml", "csv", "nvml")
+
     listenAddress = kingpin.Flag(
         "telemetry.addr",
         "host:port for exporter.",
@@ -51,6 +54,96 @@ var (
         "telemetry.path",
         "URL Path under which to expose metrics.",
     ).Default("/metrics").String()
+
+    timeoutMargin = kingpin.Flag(
+        "scrape.timeout-margin",
+        "Seconds to subtract from the timeout allowed by the client. Tune to allow for overhead or high loads.",
+    ).Default("0.5").Float64()
+
+    pollInterval = kingpin.Flag(
+        "collector.poll-interval",
+        "Run the command in the background at this interval and serve the latest snapshot on scrape. 0 runs the command on every scrape.",
+    ).Default("0s").Duration()
+
+    maxAge = kingpin.Flag(
+        "collector.max-age",
+        "Maximum age of a background polled snapshot before nvidia_smi_collector_success reports 0.",
+    ).Default("1m").Duration()
+
+    energyEnabled = kingpin.Flag(
+        "collector.energy",
+        "Export nvidia_energy_joules_total, from the driver energy counter or by integrating power draw.",
+    ).Default("false").Bool()
+
+    energySampleInterval = kingpin.Flag(
+        "collector.energy.sample-interval",
+        "Interval to sample power draw in the background for the energy counter when --collector.poll-interval is not set. 0 only samples on scrape.",
+    ).Default("5s").Duration()
+
+    energyStateFile = kingpin.Flag(
+        "collector.energy.state-file",
+        "File the energy counters are saved to so they survive restarts. Empty keeps them in memory only.",
+    ).Default("").String()
+
+    encoderSessions = kingpin.Flag(
+        "collector.encoder-sessions",
+        "Export per session encoder metrics from `nvidia-smi encodersessions`, this runs a second command per collection.",
+    ).Default("false").Bool()
+
+    nvLink = kingpin.Flag(
+        "collector.nvlink",
+        "Export NVLink state, speed, error and throughput counters from the `nvidia-smi nvlink` subcommands, this runs up to four more commands per collection.",
+    ).Default("false").Bool()
+
+    topology = kingpin.Flag(
+        "collector.topology",
+        "Export the GPU interconnect matrix and CPU/NUMA affinity from `nvidia-smi topo -m`.",
+    ).Default("false").Bool()
+
+    topologyInterval = kingpin.Flag(
+        "collector.topology.refresh-interval",
+        "Interval to refresh the topology at, it only changes with hardware or driver changes.",
+    ).Default("5m").Duration()
+
+    dmon = kingpin.Flag(
+        "collector.dmon",
+        "Keep `nvidia-smi dmon` running and export the min, max and avg of its samples over the last --collector.dmon.window as nvidia_dmon_* metrics.",
+    ).Default("false").Bool()
+
+    dmonDelay = kingpin.Flag(
+        "collector.dmon.delay",
+        "Seconds between dmon samples, at least 1.",
+    ).Default("1").Int()
+
+    dmonWindow = kingpin.Flag(
+        "collector.dmon.window",
+        "Window of the dmon and pmon samples aggregated by each scrape, at least the scrape interval so no sample is missed.",
+    ).Default("1m").Duration()
+
+    pmon = kingpin.Flag(
+        "collector.dmon.pmon",
+        "With --collector.dmon, also keep `nvidia-smi pmon` running and export per process nvidia_pmon_* metrics.",
+    ).Default("false").Bool()
+
+    queryFields = kingpin.Flag(
+        "collector.query-fields",
+        "Comma separated `nvidia-smi --query-gpu` fields to export as nvidia_query_<field> metrics, eg. temperature.gpu,power.draw. This runs a second command per collection.",
+    ).Default("").String()
+
+    queryFieldSpecs = kingpin.Flag(
+        "collector.query-field",
+        "A `nvidia-smi --query-gpu` field to export with its own metric name, scale and help as field=metric:scale:help, eg. memory.used=gpu_memory_used_bytes:1048576. Empty parts keep the defaults. Repeatable.",
+    ).Strings()
+
+    gpuLabels = kingpin.Flag(
+        "gpu.labels",
+        "Comma separated labels identifying a GPU on every per-GPU metric. Any of gpu (index), uuid, pci_bus_id, minor_number, serial.",
+    ).Default("gpu").String()
+
+    processLimit = kingpin.Flag(
+        "collector.process-limit",
+        "Maximum number of process series per GPU, the processes using the most memory are kept. 0 means no limit.",
+    ).Default("20").Int()
 )
 
 /**
@@ -97,19 +190,27 @@ func isCommandAvailable(name string) bool {
 //================ SERVER ===========================
 //===================================================
 */
-func metrics(w http.ResponseWriter, r *http.Request) {
-    metricsUpdate()
+type metricsHandler struct {
+    collector     *NvidiaSmiCollector
+    timeoutMargin float64
+}
+
+func (mh *metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    t := mh.timeoutSeconds(r)
+
+    // the GPU collector runs under the deadline of this scrape
+    reg := prometheus.NewRegistry()
+    reg.MustRegister(mh.collector.WithTimeout(time.Duration(t * float64(time.Second))))
 
     h := promhttp.HandlerFor(
-        prometheus.DefaultGatherer, 
+        prometheus.Gatherers{prometheus.DefaultGatherer, reg},
         promhttp.HandlerOpts{},
     )
     h.ServeHTTP(w, r)
 }
-    
 
 // https://github.com/prometheus-community/windows_exporter/blob/master/exporter.go
-func timeoutSeconds(r *http.Request) float64 {
+func (mh *metricsHandler) timeoutSeconds(r *http.Request) float64 {
     // == TIMEOUT for long running collectors
     const defaultTimeout = 10.0
     var t float64
@@ -123,7 +224,11 @@ func timeoutSeconds(r *http.Request) float64 {
     if t == 0 {
         t = defaultTimeout
     }
-    //t = t - mh.timeoutMargin
+    if t > mh.timeoutMargin {
+        t = t - mh.timeoutMargin
+    } else {
+        log.Warnf("Timeout margin %f is not smaller than the scrape timeout %f, ignoring it", mh.timeoutMargin, t)
+    }
     return t
 }
 
@@ -168,53 +273,6 @@ func outputHtml(w http.ResponseWriter, s string) {
     }
 }
 
-/**
-//===================================================
-//================ SERVICE ==========================
-//===================================================
-*/
-/*
-func initWbem() {
-    // This initialization prevents a memory leak on WMF 5+. See
-    // https://github.com/prometheus-community/windows_exporter/issues/77 and
-    // linked issues for details.
-    log.Debugf("Initializing SWbemServices")
-    s, err := wmi.InitializeSWbemServices(wmi.DefaultClient)
-    if err != nil {
-        log.Fatal(err)
-    }
-    wmi.DefaultClient.AllowMissingFields = true
-    wmi.DefaultClient.SWbemServicesClient = s
-}
-*/
-
-type exporterService struct {
-    stopCh chan<- bool
-}
-
-func (s *exporterService) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (ssec bool, errno uint32) {
-    const cmdsAccepted = svc.AcceptStop | svc.AcceptShutdown
-    changes <- svc.Status{State: svc.StartPending}
-    changes <- svc.Status{State: svc.Running, Accepts: cmdsAccepted}
-loop:
-    for {
-        select {
-        case c := <-r:
-            switch c.Cmd {
-            case svc.Interrogate:
-                changes <- c.CurrentStatus
-            case svc.Stop, svc.Shutdown:
-                s.stopCh <- true
-                break loop
-            default:
-                log.Error(fmt.Sprintf("unexpected control request #%d", c))
-            }
-        }
-    }
-    changes <- svc.Status{State: svc.StopPending}
-    return
-}
-
 /**
 //===================================================
 //================ MAIN =============================
@@ -226,8 +284,9 @@ func main() {
     kingpin.HelpFlag.Short('h')
     kingpin.Parse()
 
-    //Check the command is available
-    if !isCommandAvailable(*commandAppPath) {
+    //Check the command is available, the nvml source runs it only for the
+    //optional collectors
+    if *source != "nvml" && !isCommandAvailable(*commandAppPath) {
         log.Fatalf("cannot start %s - Command not available: %s", NAME, *commandAppPath)
     }
     
@@ -237,26 +296,62 @@ func main() {
     //     listenAddress = LISTEN_ADDRESS
     // }
 
-    // ----------- Service ----------
-    isInteractive, err := svc.IsAnInteractiveSession()
+    // ----------- Collector ----------
+    labels := strings.Split(*gpuLabels, ",")
+    for i := range labels {
+        labels[i] = strings.TrimSpace(labels[i])
+    }
+    if err := validateGPULabels(labels); err != nil {
+        log.Fatalf("invalid --gpu.labels: %v", err)
+    }
+
+    collector, err := NewNvidiaSmiCollector(CollectorOpts{
+        Command: *commandAppPath,
+        Flags:   strings.Fields(*commandFlags),
+        Source:  *source,
+
+        PollInterval: *pollInterval,
+        MaxAge:       *maxAge,
+        EnergyEnabled:        *energyEnabled,
+        EnergySampleInterval: *energySampleInterval,
+        EnergyStateFile:      *energyStateFile,
+
+        EncoderSessions: *encoderSessions,
+        NvLink:          *nvLink,
+        QueryFields:     append(strings.Split(*queryFields, ","), *queryFieldSpecs...),
+
+        Topology:         *topology,
+        TopologyInterval: *topologyInterval,
+
+        Dmon:       *dmon,
+        DmonDelay:  *dmonDelay,
+        DmonWindow: *dmonWindow,
+        Pmon:       *pmon,
+
+        GPULabels:    labels,
+        ProcessLimit: *processLimit,
+    })
     if err != nil {
-        log.Fatal(err)
+        log.Fatalf("cannot create collector: %v", err)
     }
 
+    stopPolling := make(chan struct{})
+    defer close(stopPolling)
+    collector.StartPolling(stopPolling)
+
+    // ----------- Service ----------
     stopCh := make(chan bool)
-    if !isInteractive {
-        go func() {
-            err = svc.Run(SERVICE_NAME, &exporterService{stopCh: stopCh})
-            if err != nil {
-                log.Errorf("Failed to start service: %v", err)
-            }
-        }()
-    }
 
+    if err := startService(stopCh); err != nil {
+        log.Fatal(err)
+    }
 
     http.HandleFunc("/", index)
     http.HandleFunc("/health", healthCheck)
-    http.HandleFunc(*metricsPath, metrics)
+    http.Handle(*metricsPath, &metricsHandler{
+        collector:     collector,
+        timeoutMargin: *timeoutMargin,
+    })
       
     
     go func() {
@@ -0,0 +1,86 @@
+package main
+
+import (
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+/**
+//===================================================
+//================ MEMORY ===========================
+//===================================================
+*/
+
+// MemoryUsage is the <fb_memory_usage> or <bar1_memory_usage> section of a
+// GPU in MiB. Newer drivers report the memory reserved by the driver
+// separately, it is part of total but neither used nor free.
+type MemoryUsage struct {
+    Total string `xml:"total"`
+    Reserved string `xml:"reserved"`
+    Used string `xml:"used"`
+    Free string `xml:"free"`
+}
+
+// usedRatio returns used memory over the memory available to applications,
+// total without the reserved memory.
+func (m *MemoryUsage) usedRatio() (float64, bool) {
+    total, used := parseValue(m.Total), parseValue(m.Used)
+    if !total.ok() || !used.ok() {
+        return 0, false
+    }
+    available := total.Value
+    if reserved := parseValue(m.Reserved); reserved.ok() {
+        available -= reserved.Value
+    }
+    if available <= 0 {
+        return 0, false
+    }
+    return used.Value / available, true
+}
+
+type memoryMetrics struct {
+    memory    *prometheus.Desc
+    bar1      *prometheus.Desc
+    usedRatio *prometheus.Desc
+}
+
+func newMemoryMetrics(gpuLabels []string) *memoryMetrics {
+    return &memoryMetrics{
+        memory: newGPUDesc(gpuLabels,
+            "nvidia_memory_bytes",
+            "FB Memory Usage - On-board frame buffer memory information in bytes. state is total, reserved (by the driver), used or free.",
+            "state",
+        ),
+        bar1: newGPUDesc(gpuLabels,
+            "nvidia_bar1_memory_bytes",
+            "BAR1 Memory Usage - memory mapped to let the CPU and 3rd party devices access the frame buffer, in bytes. state is total, used or free.",
+            "state",
+        ),
+        usedRatio: newGPUDesc(gpuLabels,
+            "nvidia_memory_used_ratio",
+            "Frame buffer memory used from 0 to 1, as used / (total - reserved).",
+        ),
+    }
+}
+
+func (m *memoryMetrics) describe(ch chan<- *prometheus.Desc) {
+    ch <- m.memory
+    ch <- m.bar1
+    ch <- m.usedRatio
+}
+
+func (m *memoryMetrics) collect(s gpuSink, gpu []string, GPU *NvidiaSmiGPU) {
+    fb := &GPU.FbMemoryUsage
+    s.gpuGauge(m.memory, gpu, "fb_memory_usage.total", fb.Total, mebibyte, "total")
+    s.gpuGauge(m.memory, gpu, "fb_memory_usage.reserved", fb.Reserved, mebibyte, "reserved")
+    s.gpuGauge(m.memory, gpu, "fb_memory_usage.used", fb.Used, mebibyte, "used")
+    s.gpuGauge(m.memory, gpu, "fb_memory_usage.free", fb.Free, mebibyte, "free")
+
+    bar1 := &GPU.Bar1MemoryUsage
+    s.gpuGauge(m.bar1, gpu, "bar1_memory_usage.total", bar1.Total, mebibyte, "total")
+    s.gpuGauge(m.bar1, gpu, "bar1_memory_usage.used", bar1.Used, mebibyte, "used")
+    s.gpuGauge(m.bar1, gpu, "bar1_memory_usage.free", bar1.Free, mebibyte, "free")
+
+    if ratio, ok := fb.usedRatio(); ok {
+        gauge(s.ch, m.usedRatio, ratio, gpu...)
+    }
+}
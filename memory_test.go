@@ -0,0 +1,13 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestMemoryMetrics(t *testing.T) {
+    // reserved is only reported by q-x-535.xml
+    for _, dump := range testDumps {
+        c := newDumpCollector(t, dump, CollectorOpts{})
+        testGolden(t, c, goldenName(dump, "memory"), "nvidia_memory_bytes", "nvidia_bar1_memory_bytes", "nvidia_memory_used_ratio")
+    }
+}
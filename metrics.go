@@ -3,14 +3,11 @@ package main
 
 import (
     "fmt"
-    "strconv"
-    "encoding/csv"
-    "encoding/xml"
-    "bytes"
+    "sort"
     "strings"
-    "regexp"
-    "os/exec"
-    "math"
+    "sync/atomic"
+    "time"
+    "context"
     "github.com/prometheus/common/log"
     "github.com/prometheus/client_golang/prometheus"
 )
@@ -56,7 +53,7 @@ var COMMAND_APP_PATHS = []string {
 */
 
 var (
-    // create our metrics  
+    // exporter level metrics, these do not depend on nvidia-smi output
     exporterInfo = prometheus.NewGaugeVec(
         prometheus.GaugeOpts{
             Name:   "nvidia_smi_exporter_build_info",
@@ -64,266 +61,546 @@ var (
         },
         []string{"version"},
     )
-    collectorSuccess = prometheus.NewGauge(
-        prometheus.GaugeOpts{
-            Name:   "nvidia_smi_collector_success",
-            Help:   "nvidia_smi_exporter: Whether the collector was successful.",
-        },
-    )
-    driverInfo = prometheus.NewGaugeVec(
-        prometheus.GaugeOpts{
-            Name:   "nvidia_driver_info",
-            Help:   "Nvidia driver information",
-        },
-        []string{"version"},
-    )
-    deviceCount = prometheus.NewGauge(
-        prometheus.GaugeOpts{
-            Name:   "nvidia_device_count",
-            Help:   "Number of GPUs in the machine",
-        },
-    )
-    gpuInfo = prometheus.NewGaugeVec(
-        prometheus.GaugeOpts{
-            Name:   "nvidia_info",
-            Help:   "GPU device information",
-        },
-        []string{"gpu", "name", "uuid", "vbios"},
-    )
-    gpuFanSpeed = prometheus.NewGaugeVec(
-        prometheus.GaugeOpts{
-            Name:   "nvidia_fanspeed_ratio",
-            Help:   "The fan speed value is the percent of maximum speed from 0 to 1 that the device's fan is currently intended to run at",
-        },
-        []string{"gpu"},
-    )
-    gpuMemory = prometheus.NewGaugeVec(
-        prometheus.GaugeOpts{
-            Name:   "nvidia_memory_bytes",
-            Help:   "FB Memory Usage - On-board frame buffer memory information in bytes.",
-        },
-        []string{"gpu", "state"},
-    )
-    gpuTemperature = prometheus.NewGaugeVec(
-        prometheus.GaugeOpts{
-            Name:   "nvidia_temperature_celsius",
-            Help:   "Percent of time over the past sample period during which one or more kernels was executing on the GPU.",
-        },
-        []string{"gpu"},
-    )
-    gpuTemperatureMax = prometheus.NewGaugeVec(
-        prometheus.GaugeOpts{
-            Name:   "nvidia_temperature_max_celsius",
-            Help:   "Maximum temperature in Celsius for the GPU.",
-        },
-        []string{"gpu"},
-    )
-    gpuTemperatureSlow = prometheus.NewGaugeVec(
-        prometheus.GaugeOpts{
-            Name:   "nvidia_temperature_slow_celsius",
-            Help:   "Temperature in Celsius where the GPU will start to slow.",
-        },
-        []string{"gpu"},
-    )
-    gpuPower = prometheus.NewGaugeVec(
-        prometheus.GaugeOpts{
-            Name:   "nvidia_power_watts",
-            Help:   "The last measured power draw for the entire board, in watts",
-        },
-        []string{"gpu"},
-    )
-    gpuPowerLimit = prometheus.NewGaugeVec(
-        prometheus.GaugeOpts{
-            Name:   "nvidia_power_limit_watts",
-            Help:   "The Limit power is set to in watts",
-        },
-        []string{"gpu"},
-    )
-
-    gpuUtilization = prometheus.NewGaugeVec(
-        prometheus.GaugeOpts{
-            Name:   "nvidia_utilization_ratio",
-            Help:   "Utilization rates report how busy each part of the GPU is over the past sample period. each part can be 0-1.",
-        },
-        []string{"gpu", "part"},
-    )
-    gpuClock = prometheus.NewGaugeVec(
-        prometheus.GaugeOpts{
-            Name:   "nvidia_clock_mhz",
-            Help:   "Current frequency at which parts of the GPU are running. All readings are in MHz.",
-        },
-        []string{"gpu", "part"},
-    )
-    gpuClockMax = prometheus.NewGaugeVec(
-        prometheus.GaugeOpts{
-            Name:   "nvidia_clock_max_mhz",
-            Help:   "Maximum frequency at which parts of the GPU are design to run. Al readings are in MHz.",
-        },
-        []string{"gpu", "part"},
-    )
 )
 
 func init() {
-    // Register all metrics.
+    // Register exporter metrics. The GPU metrics are registered in main
+    // via NewNvidiaSmiCollector once the command line flags are parsed.
     prometheus.MustRegister(exporterInfo)
-    prometheus.MustRegister(collectorSuccess)
-    prometheus.MustRegister(driverInfo)
-    prometheus.MustRegister(deviceCount)
-    prometheus.MustRegister(gpuFanSpeed)
-    prometheus.MustRegister(gpuInfo)
-    prometheus.MustRegister(gpuMemory)
-    prometheus.MustRegister(gpuTemperature)
-    prometheus.MustRegister(gpuTemperatureMax)
-    prometheus.MustRegister(gpuTemperatureSlow)
-    prometheus.MustRegister(gpuPower)
-    prometheus.MustRegister(gpuPowerLimit)
-    prometheus.MustRegister(gpuUtilization)
-    prometheus.MustRegister(gpuClock)
-    prometheus.MustRegister(gpuClockMax)
+    exporterInfo.With(prometheus.Labels{"version": version}).Set(1)
 
     // Add Go module build info.
     prometheus.MustRegister(prometheus.NewBuildInfoCollector())
 }
 
-
 /**
 //===================================================
-//================ UPDATE METRICS  ==================
+//================ COLLECTOR ========================
 //===================================================
 */
 
-func metricsUpdate() {
-    metricsXml()
+// CollectorOpts configures a NvidiaSmiCollector.
+type CollectorOpts struct {
+    // Command is the nvidia-smi name or full path.
+    Command string
+    // Flags are passed to Command by the xml source, they must produce the
+    // -q -x XML dump.
+    Flags []string
+    // Source selects the GPUSource, xml (default), csv or nvml.
+    Source string
+    // Timeout bounds a Collect call, 0 means no timeout.
+    // The metrics handler uses the scrape timeout instead, see WithTimeout.
+    Timeout time.Duration
+    // PollInterval enables background polling when > 0, scrapes are then
+    // served from the latest snapshot instead of running Command.
+    PollInterval time.Duration
+    // MaxAge is the oldest snapshot served as successful in polling mode.
+    MaxAge time.Duration
+    // EnergyEnabled exports nvidia_energy_joules_total. Without polling
+    // power draw is sampled in the background every EnergySampleInterval.
+    EnergyEnabled bool
+    EnergySampleInterval time.Duration
+    // EnergyStateFile persists the energy counters, "" keeps them in memory.
+    EnergyStateFile string
+    // EncoderSessions adds per session metrics from `nvidia-smi encodersessions`.
+    EncoderSessions bool
+    // QueryFields are `nvidia-smi --query-gpu` field specs each exported as
+    // a metric, see parseQueryFields.
+    QueryFields []string
+    // NvLink adds per link metrics from the `nvidia-smi nvlink` subcommands.
+    NvLink bool
+    // Topology adds the `nvidia-smi topo -m` matrix, refreshed at most once
+    // per TopologyInterval.
+    Topology bool
+    TopologyInterval time.Duration
+    // Dmon keeps `nvidia-smi dmon` running, sampling every DmonDelay
+    // seconds, and exports the min, max and avg of the samples of the last
+    // DmonWindow. Pmon does the same per process with `nvidia-smi pmon`.
+    Dmon bool
+    DmonDelay int
+    DmonWindow time.Duration
+    Pmon bool
+    // GPULabels are the labels identifying a GPU on every per-GPU series,
+    // see gpuIdentityLabels. Defaults to the index label gpu.
+    GPULabels []string
+    // ProcessLimit caps the process series per GPU to the processes using
+    // the most memory, 0 means no limit.
+    ProcessLimit int
 }
 
+// NvidiaSmiCollector runs nvidia-smi on every scrape and builds const
+// metrics from the parsed NvidiaSmiLog, so each scrape reflects exactly
+// what nvidia-smi reported - GPUs, processes or drivers that disappear
+// also disappear from the output.
+type NvidiaSmiCollector struct {
+    opts        CollectorOpts
+    source      GPUSource
+    gpuLabels   []string
+    infoLabels  []string
+    poller      *poller
+    sampler     *poller
+    energy      *energyMeter
+    migProfiles *migProfileCache
+    topology    *topologyCache
+    dmon        *dmonSampler
+    queryFields []queryField
+    queryHelp   queryHelp
+    queries     queryGroup
+    errors      fieldErrors
+
+    // metric groups for the sections of each <gpu> element
+    groups []gpuMetrics
+
+    success          *prometheus.Desc
+    timeout          *prometheus.Desc
+    snapshotAge      *prometheus.Desc
+    coalesced        *prometheus.Desc
+    fieldUnavailable *prometheus.Desc
+    driverInfo       *prometheus.Desc
+    deviceCount      *prometheus.Desc
+    gpuInfo          *prometheus.Desc
+    gpuUtilization   *prometheus.Desc
+    processCount     *prometheus.Desc
+    processMemory    *prometheus.Desc
+}
 
-func metricsXml() {
-    //set the version from the current git label
-    exporterInfo.With(prometheus.Labels{"version": version}).Set(1)
-    
-    //make sure its 0 until the end of this method
-    collectorSuccess.Set(0)
-
-    //get the set commandaAppPath
-    command := *commandAppPath
-    flags := *commandFlags
-    f := strings.Split(flags, " ")
-
-    // create our command - unpack the array of flags
-    cmd := exec.Command(command, f...)
-    // log.Debugf("command:", cmd.String())
-    log.Infoln("command:", cmd.String())
-
-    // Execute system command
-    stdout, err := cmd.Output()
+// gpuMetrics is a group of per-GPU metrics for one section of the <gpu>
+// element, eg. ECC errors. Groups live in their own file next to the XML
+// structs they read.
+type gpuMetrics interface {
+    describe(ch chan<- *prometheus.Desc)
+    // collect sends the metrics for one GPU, gpu holds its label values.
+    collect(s gpuSink, gpu []string, GPU *NvidiaSmiGPU)
+}
+
+// gpuSink is where the gpu* helpers send the readings of one export.
+// Readings that are not a number go to unavailable, labelled like
+// nvidia_smi_field_unavailable_total, a nil unavailable drops them.
+type gpuSink struct {
+    ch          chan<- prometheus.Metric
+    unavailable func(labels []string)
+}
+
+// NewNvidiaSmiCollector creates a collector for the given options. It fails
+// when the source is unknown or cannot be initialised.
+func NewNvidiaSmiCollector(opts CollectorOpts) (*NvidiaSmiCollector, error) {
+    source, err := newGPUSource(opts)
     if err != nil {
-        log.Errorln(err.Error())
-        return
+        return nil, err
+    }
+
+    gpuLabels := opts.GPULabels
+    if len(gpuLabels) == 0 {
+        gpuLabels = defaultGPULabels
+    }
+    // nvidia_info carries every identity label so other series can be joined
+    infoLabels := infoGPULabels(gpuLabels)
+
+    c := &NvidiaSmiCollector{
+        opts:       opts,
+        source:     source,
+        gpuLabels:  gpuLabels,
+        infoLabels: infoLabels,
+
+        migProfiles: newMigProfileCache(opts.Command),
+
+        success: prometheus.NewDesc(
+            "nvidia_smi_collector_success",
+            "nvidia_smi_exporter: Whether the collector was successful.",
+            nil, nil,
+        ),
+        timeout: prometheus.NewDesc(
+            "nvidia_smi_collector_timeout",
+            "nvidia_smi_exporter: Whether the command timed out before the scrape deadline.",
+            nil, nil,
+        ),
+        snapshotAge: prometheus.NewDesc(
+            "nvidia_smi_snapshot_age_seconds",
+            "nvidia_smi_exporter: Age of the background polled snapshot served by this scrape.",
+            nil, nil,
+        ),
+        coalesced: prometheus.NewDesc(
+            "nvidia_smi_scrapes_coalesced_total",
+            "nvidia_smi_exporter: Number of scrapes that shared the result of a concurrent nvidia-smi run.",
+            nil, nil,
+        ),
+        fieldUnavailable: newGPUDesc(gpuLabels,
+            "nvidia_smi_field_unavailable_total",
+            "nvidia_smi_exporter: Number of readings that were not a number (N/A, [Not Supported], [Insufficient Permissions], Unknown Error) and were left out of the scrape.",
+            "field", "reason",
+        ),
+        driverInfo: prometheus.NewDesc(
+            "nvidia_driver_info",
+            "Nvidia driver information",
+            []string{"version"}, nil,
+        ),
+        deviceCount: prometheus.NewDesc(
+            "nvidia_device_count",
+            "Number of GPUs in the machine",
+            nil, nil,
+        ),
+        gpuInfo: newGPUDesc(infoLabels,
+            "nvidia_info",
+            "GPU device information",
+            "name", "vbios",
+        ),
+        gpuUtilization: newGPUDesc(gpuLabels,
+            "nvidia_utilization_ratio",
+            "Utilization rates report how busy each part of the GPU is over the past sample period. each part can be 0-1.",
+            "part",
+        ),
+        processCount: newGPUDesc(gpuLabels,
+            "nvidia_process_count",
+            "Number of processes using the GPU, including those left out by the process limit.",
+        ),
+        processMemory: newGPUDesc(gpuLabels,
+            "nvidia_process_memory_bytes",
+            "GPU memory used by a process in bytes. type is C for compute, G for graphics or C+G for both. gpu_instance_id and compute_instance_id are the MIG device the process runs on, empty without MIG.",
+            "pid", "process_name", "type", "gpu_instance_id", "compute_instance_id",
+        ),
     }
 
-    // Parse XML
-    var xmlData NvidiaSmiLog
-    xml.Unmarshal(stdout, &xmlData)
+    c.groups = []gpuMetrics{
+        newClockMetrics(gpuLabels),
+        newTemperatureMetrics(gpuLabels),
+        newFanMetrics(gpuLabels),
+        newMemoryMetrics(gpuLabels),
+        newMigMetrics(gpuLabels),
+        newEncoderMetrics(gpuLabels),
+        newEccMetrics(gpuLabels),
+        newRetirementMetrics(gpuLabels),
+        newThrottleMetrics(gpuLabels),
+        newPCIeMetrics(gpuLabels),
+        newPowerMetrics(gpuLabels),
+        newNvLinkMetrics(gpuLabels),
+    }
 
-    // SANITY CHECK results
-    if xmlData.DriverVersion =="" {
-        log.Errorln("Nvidia DriverVersion not parsed correctly")
-        return
+    if opts.EnergyEnabled {
+        c.energy = newEnergyMeter(opts.EnergyStateFile)
+        c.groups = append(c.groups, newEnergyMetrics(gpuLabels, c.energy))
+    }
+    queryFields, err := parseQueryFields(opts.QueryFields)
+    if err != nil {
+        return nil, fmt.Errorf("invalid query fields: %v", err)
+    }
+    if len(queryFields) > 0 {
+        c.queryHelp = probeQueryHelp(opts.Command, "--help-query-gpu")
+        queryFields = c.queryHelp.knownFields(queryFields)
+    }
+    if len(queryFields) > 0 {
+        c.queryFields = queryFields
+        c.groups = append(c.groups, newQueryFieldMetrics(gpuLabels, queryFields))
+    }
+    if opts.Topology {
+        c.topology = newTopologyCache(opts.Command, opts.TopologyInterval)
+        c.groups = append(c.groups, newTopologyMetrics(gpuLabels))
+    }
+    if opts.Dmon {
+        c.dmon = newDmonSampler(opts.Command, opts.DmonDelay, opts.DmonWindow, opts.Pmon)
+        c.groups = append(c.groups, newDmonMetrics(gpuLabels, opts.Pmon))
     }
 
+    if opts.PollInterval > 0 {
+        c.poller = newPoller(opts.PollInterval, c.query)
+    } else if opts.EnergyEnabled && opts.EnergySampleInterval > 0 {
+        // only feeds the energy meter, scrapes still run the command
+        c.sampler = newPoller(opts.EnergySampleInterval, c.sampleEnergy)
+    }
+    return c, nil
+}
 
-    driverInfo.With(prometheus.Labels{"version": xmlData.DriverVersion}).Set(1)
-    deviceCount.Set(filterNumber(xmlData.AttachedGPUs))
+// StartPolling starts the background poll loop when PollInterval is set,
+// or the energy sampler when energy is enabled without polling, and the
+// dmon streams. The loops stop when stop is closed.
+func (c *NvidiaSmiCollector) StartPolling(stop <-chan struct{}) {
+    if c.poller != nil {
+        log.Infof("polling %s every %s", c.opts.Command, c.opts.PollInterval)
+        go c.poller.run(stop)
+    }
+    if c.sampler != nil {
+        log.Infof("sampling power draw every %s", c.opts.EnergySampleInterval)
+        go c.sampler.run(stop)
+    }
+    if c.dmon != nil {
+        log.Infof("streaming %s dmon every %ds", c.opts.Command, c.dmon.delay)
+        c.dmon.run(stop)
+    }
+}
 
-    // for each GPU
-    for i, GPU := range xmlData.GPUs {
-        var idx = strconv.Itoa(i)
+// Describe implements prometheus.Collector.
+func (c *NvidiaSmiCollector) Describe(ch chan<- *prometheus.Desc) {
+    ch <- c.success
+    ch <- c.timeout
+    if c.poller != nil {
+        ch <- c.snapshotAge
+    }
+    ch <- c.coalesced
+    ch <- c.fieldUnavailable
+    ch <- c.driverInfo
+    ch <- c.deviceCount
+    ch <- c.gpuInfo
+    ch <- c.gpuUtilization
+    ch <- c.processCount
+    ch <- c.processMemory
+    for _, g := range c.groups {
+        g.describe(ch)
+    }
+}
 
-        gpuInfo.With(prometheus.Labels{"gpu": idx, "name": GPU.ProductName, "uuid": GPU.UUID, "vbios": GPU.VBiosVersion}).Set(1)
-        gpuFanSpeed.With(prometheus.Labels{"gpu": idx}).Set(filterNumber(GPU.FanSpeed)/100)
+// Collect implements prometheus.Collector.
+func (c *NvidiaSmiCollector) Collect(ch chan<- prometheus.Metric) {
+    c.collectWithTimeout(ch, c.opts.Timeout)
+}
 
-        gpuMemory.With(prometheus.Labels{"gpu": idx, "state": "used"}).Set(megabytesToBytes(filterNumber(GPU.FbMemoryUsage.Used)))
-        gpuMemory.With(prometheus.Labels{"gpu": idx, "state": "free"}).Set(megabytesToBytes(filterNumber(GPU.FbMemoryUsage.Free)))
+// WithTimeout returns a prometheus.Collector that shares this collector's
+// descriptors but runs the command under the given timeout.
+func (c *NvidiaSmiCollector) WithTimeout(timeout time.Duration) prometheus.Collector {
+    return &timeoutCollector{c: c, timeout: timeout}
+}
 
-        gpuTemperature.With(prometheus.Labels{"gpu": idx}).Set(filterNumber(GPU.Temperature.GPUTemp))
-        gpuTemperatureMax.With(prometheus.Labels{"gpu": idx}).Set(filterNumber(GPU.Temperature.GPUTempMaxThreshold))
-        gpuTemperatureSlow.With(prometheus.Labels{"gpu": idx}).Set(filterNumber(GPU.Temperature.GPUTempSlowThreshold))
+type timeoutCollector struct {
+    c       *NvidiaSmiCollector
+    timeout time.Duration
+}
 
-        gpuPower.With(prometheus.Labels{"gpu": idx}).Set(filterNumber(GPU.PowerReadings.PowerDraw))
-        gpuPowerLimit.With(prometheus.Labels{"gpu": idx}).Set(filterNumber(GPU.PowerReadings.PowerLimit))
+func (t *timeoutCollector) Describe(ch chan<- *prometheus.Desc) {
+    t.c.Describe(ch)
+}
 
-        gpuUtilization.With(prometheus.Labels{"gpu": idx, "part": "gpu"}).Set(filterNumber(GPU.Utilization.GPUUtil)/100)
-        gpuUtilization.With(prometheus.Labels{"gpu": idx, "part": "memory"}).Set(filterNumber(GPU.Utilization.MemoryUtil)/100)
-        gpuUtilization.With(prometheus.Labels{"gpu": idx, "part": "encoder"}).Set(filterNumber(GPU.Utilization.EncoderUtil)/100)
-        gpuUtilization.With(prometheus.Labels{"gpu": idx, "part": "decoder"}).Set(filterNumber(GPU.Utilization.DecoderUtil)/100)
+func (t *timeoutCollector) Collect(ch chan<- prometheus.Metric) {
+    t.c.collectWithTimeout(ch, t.timeout)
+}
 
-        gpuClock.With(prometheus.Labels{"gpu": idx, "part": "graphics"}).Set(filterNumber(GPU.Clocks.GraphicsClock))
-        gpuClock.With(prometheus.Labels{"gpu": idx, "part": "sm"}).Set(filterNumber(GPU.Clocks.SmClock))
-        gpuClock.With(prometheus.Labels{"gpu": idx, "part": "memory"}).Set(filterNumber(GPU.Clocks.MemClock))
-        gpuClock.With(prometheus.Labels{"gpu": idx, "part": "video"}).Set(filterNumber(GPU.Clocks.VideoClock))
+func (c *NvidiaSmiCollector) collectWithTimeout(ch chan<- prometheus.Metric, timeout time.Duration) {
+    defer func() {
+        ch <- prometheus.MustNewConstMetric(c.coalesced, prometheus.CounterValue, float64(c.queries.coalescedCount()))
+        c.errors.collect(ch, c.fieldUnavailable)
+    }()
 
-        gpuClockMax.With(prometheus.Labels{"gpu": idx, "part": "graphics"}).Set(filterNumber(GPU.MaxClocks.GraphicsClock))
-        gpuClockMax.With(prometheus.Labels{"gpu": idx, "part": "sm"}).Set(filterNumber(GPU.MaxClocks.SmClock))
-        gpuClockMax.With(prometheus.Labels{"gpu": idx, "part": "memory"}).Set(filterNumber(GPU.MaxClocks.MemClock))
-        gpuClockMax.With(prometheus.Labels{"gpu": idx, "part": "video"}).Set(filterNumber(GPU.MaxClocks.VideoClock))
+    if c.poller != nil {
+        c.collectSnapshot(ch)
+        return
+    }
 
+    ctx := context.Background()
+    if timeout > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, timeout)
+        defer cancel()
     }
-    collectorSuccess.Set(1)
-}
 
-func megabytesToBytes(mb float64) float64 {
-    return math.Round(mb * 1048576)
-}
+    xmlData, err := c.query(ctx)
+    if err == context.DeadlineExceeded {
+        log.Warnf("%s timed out after %s, consider raising the scrape timeout", c.opts.Command, timeout)
+        gauge(ch, c.timeout, 1)
+        gauge(ch, c.success, 0)
+        return
+    }
+    gauge(ch, c.timeout, 0)
+    if err != nil {
+        log.Errorln(err)
+        gauge(ch, c.success, 0)
+        return
+    }
 
-func mHzToHz(mHz int) float64 {
-    return float64(mHz) * 1000 * 1000
+    c.exportLog(ch, xmlData)
+    gauge(ch, c.success, 1)
 }
 
+// collectSnapshot serves the latest background polled snapshot.
+// Snapshots older than MaxAge are not served and mark the scrape as failed.
+func (c *NvidiaSmiCollector) collectSnapshot(ch chan<- prometheus.Metric) {
+    xmlData, updated, err := c.poller.latest()
+    gauge(ch, c.timeout, boolToFloat(err == context.DeadlineExceeded))
+
+    if xmlData == nil {
+        log.Warnln("no successful background poll yet")
+        gauge(ch, c.success, 0)
+        return
+    }
+
+    age := time.Since(updated)
+    gauge(ch, c.snapshotAge, age.Seconds())
+    if c.opts.MaxAge > 0 && age > c.opts.MaxAge {
+        log.Warnf("latest snapshot is %s old, older than the max age %s", age, c.opts.MaxAge)
+        gauge(ch, c.success, 0)
+        return
+    }
+
+    c.exportLog(ch, xmlData)
+    gauge(ch, c.success, 1)
+}
 
 /**
-* get metrics based on csv
-/ name, index, temperature.gpu, utilization.gpu, utilization.memory, memory.total, memory.free, memory.used
-//nvidia-smi --query-gpu=name,index,temperature.gpu,utilization.gpu,utilization.memory,memory.total,memory.free,memory.used --format=csv,noheader,nounits
+//===================================================
+//================ UPDATE METRICS  ==================
+//===================================================
 */
-func metricsCsv() string {
 
-    nvidiaSmiPath := *commandAppPath
- 
-    out, err := exec.Command(
-        nvidiaSmiPath,
-        "--query-gpu=name,index,temperature.gpu,utilization.gpu,utilization.memory,memory.total,memory.free,memory.used",
-        "--format=csv,noheader,nounits").Output()
+// query queries the source for a snapshot. Concurrent calls share a single
+// source query.
+func (c *NvidiaSmiCollector) query(ctx context.Context) (*NvidiaSmiLog, error) {
+    return c.queries.do(ctx, c.runQuery)
+}
 
+// runQuery queries the source and adds the optional side queries, for the
+// scrape and poll paths.
+func (c *NvidiaSmiCollector) runQuery(ctx context.Context) (*NvidiaSmiLog, error) {
+    xmlData, err := c.source.Query(ctx)
     if err != nil {
-        return fmt.Sprintf("%s\n", err)
+        return nil, err
     }
+    // the side queries below can take a while
+    sampled := time.Now()
 
-    csvReader := csv.NewReader(bytes.NewReader(out))
-    csvReader.TrimLeadingSpace = true
-    records, err := csvReader.ReadAll()
+    xmlData.addMigProfiles(c.migProfiles.get(ctx, xmlData))
+    if c.opts.EncoderSessions {
+        xmlData.addEncoderSessions(ctx, c.opts.Command)
+    }
+    if c.queryFields != nil {
+        xmlData.addQueryFields(ctx, c.opts.Command, c.queryFields, c.queryHelp)
+    }
+    if c.opts.NvLink {
+        xmlData.addNvLinks(ctx, c.opts.Command)
+    }
+    if c.topology != nil {
+        xmlData.addTopology(c.topology.get(ctx))
+    }
+    if c.dmon != nil {
+        xmlData.addSamples(c.dmon.stats(time.Now()))
+    }
+
+    if c.energy != nil {
+        c.energy.observe(xmlData, sampled)
+    }
+    return xmlData, nil
+}
 
+// sampleEnergy only queries the source to feed the energy meter, the side
+// queries are left to the scrapes.
+func (c *NvidiaSmiCollector) sampleEnergy(ctx context.Context) (*NvidiaSmiLog, error) {
+    xmlData, err := c.source.Query(ctx)
     if err != nil {
-        return fmt.Sprintf("%s\n", err)
+        return nil, err
     }
+    c.energy.observe(xmlData, time.Now())
+    return xmlData, nil
+}
+
+// exportLog sends the metrics for a parsed NvidiaSmiLog, leaving out the
+// readings that are not a number. The first export of a snapshot counts
+// those readings, so the counts do not depend on how many scrapes a polled
+// snapshot serves, and drops the counts of GPUs that are gone.
+func (c *NvidiaSmiCollector) exportLog(ch chan<- prometheus.Metric, xmlData *NvidiaSmiLog) {
+    s := gpuSink{ch: ch}
+    if atomic.CompareAndSwapInt32(&xmlData.counted, 0, 1) {
+        s.unavailable = func(labels []string) {
+            c.errors.inc(labels...)
+        }
+        gpus := make([][]string, len(xmlData.GPUs))
+        for i := range xmlData.GPUs {
+            gpus[i] = gpuLabelValues(c.gpuLabels, i, &xmlData.GPUs[i])
+        }
+        c.errors.retain(gpus)
+    }
+    c.collectLog(s, xmlData)
+}
+
+// collectLog sends the metrics for a parsed NvidiaSmiLog to s.
+func (c *NvidiaSmiCollector) collectLog(s gpuSink, xmlData *NvidiaSmiLog) {
+    gauge(s.ch, c.driverInfo, 1, xmlData.DriverVersion)
+    if count := parseValue(xmlData.AttachedGPUs); count.ok() {
+        gauge(s.ch, c.deviceCount, count.Value)
+    }
+
+    // for each GPU
+    seen := map[string]bool{}
+    for i, GPU := range xmlData.GPUs {
+        var gpu = gpuLabelValues(c.gpuLabels, i, &GPU)
+
+        info := append(gpuLabelValues(c.infoLabels, i, &GPU), GPU.ProductName, GPU.VBiosVersion)
+        gauge(s.ch, c.gpuInfo, 1, info...)
+
+        // two GPUs with the same labels would fail the whole scrape
+        key := strings.Join(gpu, "\xff")
+        if seen[key] {
+            log.Warnf("GPU %d has the same labels %v as another GPU, leaving out its metrics", i, gpu)
+            continue
+        }
+        seen[key] = true
+
+        s.gpuGauge(c.gpuUtilization, gpu, "utilization.gpu_util", GPU.Utilization.GPUUtil, 0.01, "gpu")
+        s.gpuGauge(c.gpuUtilization, gpu, "utilization.memory_util", GPU.Utilization.MemoryUtil, 0.01, "memory")
+        s.gpuGauge(c.gpuUtilization, gpu, "utilization.encoder_util", GPU.Utilization.EncoderUtil, 0.01, "encoder")
+        s.gpuGauge(c.gpuUtilization, gpu, "utilization.decoder_util", GPU.Utilization.DecoderUtil, 0.01, "decoder")
+
+        // copy, the snapshot may be shared with concurrent scrapes
+        processes := append(GPU.Processes.ProcessInfo[:0:0], GPU.Processes.ProcessInfo...)
+        gauge(s.ch, c.processCount, float64(len(processes)), gpu...)
+
+        // keep the processes using the most memory when over the limit
+        sort.SliceStable(processes, func(a, b int) bool {
+            return parseValue(processes[a].UsedMemory).Value > parseValue(processes[b].UsedMemory).Value
+        })
+        if c.opts.ProcessLimit > 0 && len(processes) > c.opts.ProcessLimit {
+            processes = processes[:c.opts.ProcessLimit]
+        }
+        for _, p := range processes {
+            s.gpuGauge(c.processMemory, gpu, "processes.process_info.used_memory", p.UsedMemory, mebibyte,
+                p.PID, p.ProcessName, p.Type, migInstanceID(p.GPUInstanceId), migInstanceID(p.ComputeInstanceId))
+        }
+
+        for _, g := range c.groups {
+            g.collect(s, gpu, &GPU)
+        }
+    }
+}
 
-    metricList := []string {
-        "temperature.gpu", "utilization.gpu",
-        "utilization.memory", "memory.total", "memory.free", "memory.used"}
+// gpuGauge sends desc for the raw reading multiplied by scale, labelled by
+// the gpu label values followed by labels. Readings that are not a number
+// are passed to s.unavailable instead, a missing element is left out
+// silently.
+func (s gpuSink) gpuGauge(desc *prometheus.Desc, gpu []string, field string, raw string, scale float64, labels ...string) {
+    s.gpuValue(desc, prometheus.GaugeValue, gpu, field, parseValue(raw), scale, labels...)
+}
+
+// gpuCounter is gpuGauge for readings that only ever increase.
+func (s gpuSink) gpuCounter(desc *prometheus.Desc, gpu []string, field string, raw string, labels ...string) {
+    s.gpuValue(desc, prometheus.CounterValue, gpu, field, parseValue(raw), 1, labels...)
+}
 
-    result := ""
-    for _, row := range records {
-        name := fmt.Sprintf("%s[%s]", row[0], row[1])
-        for idx, value := range row[2:] {
-            result = fmt.Sprintf(
-                "%s%s{gpu=\"%s\"} %s\n", result,
-                metricList[idx], name, value)
+// gpuFlag is gpuGauge for Enabled/Disabled style readings, reported as 1/0.
+func (s gpuSink) gpuFlag(desc *prometheus.Desc, gpu []string, field string, raw string, labels ...string) {
+    s.gpuValue(desc, prometheus.GaugeValue, gpu, field, parseFlag(raw), 1, labels...)
+}
+
+func (s gpuSink) gpuValue(desc *prometheus.Desc, valueType prometheus.ValueType, gpu []string, field string, v smiValue, scale float64, labels ...string) {
+    switch v.Status {
+    case valueOK:
+        values := append(append([]string{}, gpu...), labels...)
+        s.ch <- prometheus.MustNewConstMetric(desc, valueType, v.Value*scale, values...)
+    case valueMissing:
+    default:
+        if s.unavailable != nil {
+            s.unavailable(append(append([]string{}, gpu...), field, v.Status.String()))
         }
     }
+}
+
+func gauge(ch chan<- prometheus.Metric, desc *prometheus.Desc, value float64, labels ...string) {
+    ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labels...)
+}
 
-    html := strings.Replace(result, ".", "_", -1)
-    return html
+func boolToFloat(b bool) float64 {
+    if b {
+        return 1
+    }
+    return 0
 }
 
+// nvidia-smi reports memory in MiB
+const mebibyte = 1048576
+
 /**
 //===================================================
 //================ METRIC PARSE  ====================
@@ -334,76 +611,84 @@ func metricsCsv() string {
 type NvidiaSmiLog struct {
     DriverVersion string `xml:"driver_version"`
     AttachedGPUs string `xml:"attached_gpus"`
-    GPUs []struct {
-        ProductName string `xml:"product_name"`
-        ProductBrand string `xml:"product_brand"`
-        VBiosVersion string `xml:"vbios_version"`
-        UUID string `xml:"uuid"`
-        FanSpeed string `xml:"fan_speed"`
-        PCI struct {
-            PCIBus string `xml:"pci_bus"`
-        } `xml:"pci"`
-        FbMemoryUsage struct {
-            Total string `xml:"total"`
-            Used string `xml:"used"`
-            Free string `xml:"free"`
-        } `xml:"fb_memory_usage"`
-        Utilization struct {
-            GPUUtil string `xml:"gpu_util"`
-            MemoryUtil string `xml:"memory_util"`
-            EncoderUtil string `xml:"encoder_util"`
-            DecoderUtil string `xml:"decoder_util"`
-        } `xml:"utilization"`
-        Temperature struct {
-            GPUTemp string `xml:"gpu_temp"`
-            GPUTempMaxThreshold string `xml:"gpu_temp_max_threshold"`
-            GPUTempSlowThreshold string `xml:"gpu_temp_slow_threshold"`
-        } `xml:"temperature"`
-        PowerReadings struct {
-            PowerDraw string `xml:"power_draw"`
-            PowerLimit string `xml:"power_limit"`
-        } `xml:"power_readings"`
-        Clocks struct {
-            GraphicsClock string `xml:"graphics_clock"`
-            SmClock string `xml:"sm_clock"`
-            MemClock string `xml:"mem_clock"`
-            VideoClock string `xml:"video_clock"`
-        } `xml:"clocks"`
-        MaxClocks struct {
-            GraphicsClock string `xml:"graphics_clock"`
-            SmClock string `xml:"sm_clock"`
-            MemClock string `xml:"mem_clock"`
-            VideoClock string `xml:"video_clock"`
-        } `xml:"max_clocks"`
-        Processes []struct {
-            ProcessInfo struct {
-                ProcessName string `xml:"process_name"`
-                UsedMemory string `xml:"used_memory"`
-                Type string `xml:"type"`
-                PID string `xml:"pid"`
-                GPUInstanceId string `xml:"gpu_instance_id"`
-                ComputeInstanceId string `xml:"compute_instance_id"`
-            } `xml:"process_info"`
-        } `xml:"processes"`
-    } `xml:"gpu"`
-}
+    GPUs []NvidiaSmiGPU `xml:"gpu"`
 
-func formatValue(key string, meta string, value string) string {
-    result := key;
-    if (meta != "") {
-        result += "{" + meta + "}";
-    }
-    return result + " " + value +"\n"
+    // counted is set by the first export, see exportLog
+    counted int32
 }
 
-func filterNumber(value string) float64 {
-    r := regexp.MustCompile("[^0-9.]")
-    v := r.ReplaceAllString(value, "")
-    f, err := strconv.ParseFloat(v, 64)
-
-    if err != nil {
-        log.Errorln("%s\n", err)
-    }
-    return f
+// NvidiaSmiGPU is a single <gpu> element of the NvidiaSmiLog
+type NvidiaSmiGPU struct {
+    ProductName string `xml:"product_name"`
+    ProductBrand string `xml:"product_brand"`
+    VBiosVersion string `xml:"vbios_version"`
+    UUID string `xml:"uuid"`
+    Serial string `xml:"serial"`
+    MinorNumber string `xml:"minor_number"`
+    FanSpeed string `xml:"fan_speed"`
+    // Fans are read per fan by the nvml source only
+    Fans []Fan `xml:"-"`
+    PCI PCI `xml:"pci"`
+    FbMemoryUsage MemoryUsage `xml:"fb_memory_usage"`
+    Bar1MemoryUsage MemoryUsage `xml:"bar1_memory_usage"`
+    MigMode MigMode `xml:"mig_mode"`
+    MigDevices struct {
+        MigDevice []MigDevice `xml:"mig_device"`
+    } `xml:"mig_devices"`
+    EncoderStats SessionStats `xml:"encoder_stats"`
+    FbcStats SessionStats `xml:"fbc_stats"`
+    // EncoderSessions are from `nvidia-smi encodersessions`
+    EncoderSessions []EncoderSession `xml:"-"`
+    // QueryFields are the --query-gpu values by field name
+    QueryFields map[string]string `xml:"-"`
+    // NvLinks are from the `nvidia-smi nvlink` subcommands
+    NvLinks []NvLink `xml:"-"`
+    // Topology is from `nvidia-smi topo -m`
+    Topology *GPUTopology `xml:"-"`
+    TopologyLinks []TopologyLink `xml:"-"`
+    // Samples are from the `nvidia-smi dmon` and `pmon` streams
+    Samples *GPUSamples `xml:"-"`
+    // MigProfiles maps GPU instance ids to their profile, from `nvidia-smi mig -lgi`
+    MigProfiles map[string]string `xml:"-"`
+    Utilization struct {
+        GPUUtil string `xml:"gpu_util"`
+        MemoryUtil string `xml:"memory_util"`
+        EncoderUtil string `xml:"encoder_util"`
+        DecoderUtil string `xml:"decoder_util"`
+    } `xml:"utilization"`
+    Temperature Temperature `xml:"temperature"`
+    PerformanceState string `xml:"performance_state"`
+    TotalEnergyConsumption string `xml:"total_energy_consumption"`
+    PowerReadings PowerReadings `xml:"power_readings"`
+    GPUPowerReadings PowerReadings `xml:"gpu_power_readings"`
+    ModulePowerReadings PowerReadings `xml:"module_power_readings"`
+    Clocks Clocks `xml:"clocks"`
+    ApplicationsClocks Clocks `xml:"applications_clocks"`
+    DefaultApplicationsClocks Clocks `xml:"default_applications_clocks"`
+    DeferredClocks Clocks `xml:"deferred_clocks"`
+    MaxClocks Clocks `xml:"max_clocks"`
+    MaxCustomerBoostClocks Clocks `xml:"max_customer_boost_clocks"`
+    ClockPolicy struct {
+        AutoBoost string `xml:"auto_boost"`
+        AutoBoostDefault string `xml:"auto_boost_default"`
+    } `xml:"clock_policy"`
+    Processes struct {
+        ProcessInfo []ProcessInfo `xml:"process_info"`
+    } `xml:"processes"`
+    EccMode EccMode `xml:"ecc_mode"`
+    EccErrors EccErrors `xml:"ecc_errors"`
+    RetiredPages RetiredPages `xml:"retired_pages"`
+    RemappedRows RemappedRows `xml:"remapped_rows"`
+    ClocksThrottleReasons ClockReasons `xml:"clocks_throttle_reasons"`
+    ClocksEventReasons ClockReasons `xml:"clocks_event_reasons"`
 }
 
+// ProcessInfo is a process using the GPU, used_memory is in MiB
+type ProcessInfo struct {
+    ProcessName string `xml:"process_name"`
+    UsedMemory string `xml:"used_memory"`
+    Type string `xml:"type"`
+    PID string `xml:"pid"`
+    GPUInstanceId string `xml:"gpu_instance_id"`
+    ComputeInstanceId string `xml:"compute_instance_id"`
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "flag"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/testutil"
+    "github.com/prometheus/common/expfmt"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden .prom files in testdata")
+
+// testDumps are the -q -x dumps run through the collector, one per power
+// layout: power_readings up to driver 525 and gpu_power_readings with
+// module_power_readings after.
+var testDumps = []string{"q-x-470.xml", "q-x-535.xml"}
+
+// dumpSource serves a parsed -q -x dump, the same snapshot on every query
+// like the poller.
+type dumpSource struct {
+    log *NvidiaSmiLog
+}
+
+func (s *dumpSource) Query(ctx context.Context) (*NvidiaSmiLog, error) {
+    return s.log, nil
+}
+
+// newDumpCollector returns a collector for opts reading the dump from
+// testdata instead of running nvidia-smi. The MIG profile cache is primed
+// with the GPU instances of the dump so `mig -lgi` is not run.
+func newDumpCollector(t *testing.T, dump string, opts CollectorOpts) *NvidiaSmiCollector {
+    t.Helper()
+    l, err := parseNvidiaSmiLog(readTestdata(t, dump))
+    if err != nil {
+        t.Fatalf("%s: %v", dump, err)
+    }
+    if opts.Command == "" {
+        opts.Command = filepath.Join("testdata", "no-nvidia-smi")
+    }
+    c, err := NewNvidiaSmiCollector(opts)
+    if err != nil {
+        t.Fatal(err)
+    }
+    c.source = &dumpSource{log: l}
+    c.migProfiles.instances = l.migInstances()
+    return c
+}
+
+// goldenName is the golden file of the dump for a test, eg.
+// q-x-535.power.prom.
+func goldenName(dump string, test string) string {
+    return strings.TrimSuffix(dump, filepath.Ext(dump)) + "." + test + ".prom"
+}
+
+// testGolden compares the metrics named names collected by c with the
+// golden file in testdata, after rewriting it with -update.
+func testGolden(t *testing.T, c prometheus.Collector, golden string, names ...string) {
+    t.Helper()
+    path := filepath.Join("testdata", golden)
+    if *update {
+        writeGolden(t, c, path, names)
+    }
+    f, err := os.Open(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer f.Close()
+    if err := testutil.CollectAndCompare(c, f, names...); err != nil {
+        t.Errorf("%s: %v", golden, err)
+    }
+}
+
+func writeGolden(t *testing.T, c prometheus.Collector, path string, names []string) {
+    t.Helper()
+    reg := prometheus.NewPedanticRegistry()
+    if err := reg.Register(c); err != nil {
+        t.Fatal(err)
+    }
+    families, err := reg.Gather()
+    if err != nil {
+        t.Fatal(err)
+    }
+    var buf bytes.Buffer
+    for _, mf := range families {
+        for _, name := range names {
+            if mf.GetName() != name {
+                continue
+            }
+            if _, err := expfmt.MetricFamilyToText(&buf, mf); err != nil {
+                t.Fatal(err)
+            }
+        }
+    }
+    if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestCollector(t *testing.T) {
+    names := []string{
+        "nvidia_smi_collector_success",
+        "nvidia_smi_collector_timeout",
+        "nvidia_smi_field_unavailable_total",
+        "nvidia_driver_info",
+        "nvidia_device_count",
+        "nvidia_info",
+        "nvidia_utilization_ratio",
+        "nvidia_process_count",
+        "nvidia_process_memory_bytes",
+    }
+    for _, dump := range testDumps {
+        testGolden(t, newDumpCollector(t, dump, CollectorOpts{}), goldenName(dump, "collector"), names...)
+    }
+
+    // identity labels and the process limit
+    c := newDumpCollector(t, "q-x-535.xml", CollectorOpts{GPULabels: []string{"uuid", "pci_bus_id"}, ProcessLimit: 1})
+    testGolden(t, c, "q-x-535.labels.prom", names...)
+}
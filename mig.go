@@ -0,0 +1,246 @@
+package main
+
+import (
+    "context"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/common/log"
+)
+
+/**
+//===================================================
+//================ MULTI-INSTANCE GPU (MIG) =========
+//===================================================
+*/
+
+// MigMode is the <mig_mode> section of a GPU, N/A on GPUs without MIG.
+type MigMode struct {
+    Current string `xml:"current_mig"`
+    Pending string `xml:"pending_mig"`
+}
+
+// MigDevice is a <mig_device> of the <mig_devices> section, one per
+// compute instance of a GPU instance.
+type MigDevice struct {
+    Index string `xml:"index"`
+    GPUInstanceID string `xml:"gpu_instance_id"`
+    ComputeInstanceID string `xml:"compute_instance_id"`
+    DeviceAttributes struct {
+        Shared struct {
+            MultiprocessorCount string `xml:"multiprocessor_count"`
+            CopyEngineCount string `xml:"copy_engine_count"`
+            EncoderCount string `xml:"encoder_count"`
+            DecoderCount string `xml:"decoder_count"`
+            OfaCount string `xml:"ofa_count"`
+            JpgCount string `xml:"jpg_count"`
+        } `xml:"shared"`
+    } `xml:"device_attributes"`
+    EccErrorCount struct {
+        VolatileCount struct {
+            SramUncorrectable string `xml:"sram_uncorrectable"`
+        } `xml:"volatile_count"`
+    } `xml:"ecc_error_count"`
+    FbMemoryUsage MemoryUsage `xml:"fb_memory_usage"`
+    Bar1MemoryUsage MemoryUsage `xml:"bar1_memory_usage"`
+}
+
+// a GPU instance row of `nvidia-smi mig -lgi`
+// |   0  MIG 3g.20gb          9        1          4:4     |
+var migInstanceRow = regexp.MustCompile(`^\|\s*(\d+)\s+MIG\s+(\S+)\s+(\d+)\s+(\d+)\s+\S+\s*\|`)
+
+// queryMigProfiles runs `nvidia-smi mig -lgi` and returns the profile name
+// of each GPU instance, keyed by GPU index and then GPU instance id.
+// The -q -x dump does not include the profile.
+func queryMigProfiles(ctx context.Context, command string) (map[int]map[string]string, error) {
+    out, err := runCommand(ctx, command, "mig", "-lgi")
+    if err != nil {
+        return nil, err
+    }
+    return parseMigProfiles(out), nil
+}
+
+// parseMigProfiles parses the GPU instance rows of `nvidia-smi mig -lgi`.
+func parseMigProfiles(out []byte) map[int]map[string]string {
+    profiles := map[int]map[string]string{}
+    for _, line := range strings.Split(string(out), "\n") {
+        m := migInstanceRow.FindStringSubmatch(strings.TrimSpace(line))
+        if m == nil {
+            continue
+        }
+        index, _ := strconv.Atoi(m[1])
+        if profiles[index] == nil {
+            profiles[index] = map[string]string{}
+        }
+        profiles[index][m[4]] = m[2]
+    }
+    return profiles
+}
+
+// migInstanceID returns a MIG instance id label value, empty for the N/A
+// reported without MIG.
+func migInstanceID(raw string) string {
+    if v := parseValue(raw); v.ok() {
+        return strings.TrimSpace(raw)
+    }
+    return ""
+}
+
+// migInstances lists the GPU instances of the MIG devices of each GPU,
+// empty without MIG.
+func (l *NvidiaSmiLog) migInstances() string {
+    var instances []string
+    for i := range l.GPUs {
+        for _, d := range l.GPUs[i].MigDevices.MigDevice {
+            instances = append(instances, strconv.Itoa(i)+":"+strings.TrimSpace(d.GPUInstanceID))
+        }
+    }
+    sort.Strings(instances)
+    return strings.Join(instances, ",")
+}
+
+// migProfileCache runs `nvidia-smi mig -lgi` only when the GPU instances of
+// the -q -x dump change, profiles only change when MIG is reconfigured.
+// The command needs root, a failure is logged once and leaves the profile
+// label empty until the instances change.
+type migProfileCache struct {
+    command string
+
+    mtx       sync.Mutex
+    instances string
+    profiles  map[int]map[string]string
+}
+
+func newMigProfileCache(command string) *migProfileCache {
+    return &migProfileCache{command: command}
+}
+
+// get returns the profiles for the GPU instances of l.
+func (m *migProfileCache) get(ctx context.Context, l *NvidiaSmiLog) map[int]map[string]string {
+    instances := l.migInstances()
+
+    m.mtx.Lock()
+    defer m.mtx.Unlock()
+
+    if instances == m.instances {
+        return m.profiles
+    }
+    profiles, err := queryMigProfiles(ctx, m.command)
+    if err != nil {
+        if ctx.Err() != nil {
+            // retry on the next query
+            return m.profiles
+        }
+        log.Warnf("cannot list MIG GPU instance profiles, the profile label stays empty until MIG is reconfigured: %v", err)
+    }
+    m.instances, m.profiles = instances, profiles
+    return profiles
+}
+
+// addMigProfiles sets the MigProfiles of each GPU, mig -lgi only names GPUs
+// by index.
+func (l *NvidiaSmiLog) addMigProfiles(profiles map[int]map[string]string) {
+    for index, p := range profiles {
+        if GPU := l.findGPU(gpuRef{index: index}); GPU != nil {
+            GPU.MigProfiles = p
+        }
+    }
+}
+
+type migMetrics struct {
+    mode        *prometheus.Desc
+    info        *prometheus.Desc
+    smCount     *prometheus.Desc
+    engineCount *prometheus.Desc
+    memory      *prometheus.Desc
+    bar1        *prometheus.Desc
+    eccErrors   *prometheus.Desc
+}
+
+func newMigMetrics(gpuLabels []string) *migMetrics {
+    return &migMetrics{
+        mode: newGPUDesc(gpuLabels,
+            "nvidia_mig_mode",
+            "Whether MIG mode is enabled (1) or disabled (0). state is current, or pending for the mode after the next GPU reset.",
+            "state",
+        ),
+        info: newGPUDesc(gpuLabels,
+            "nvidia_mig_info",
+            "MIG device information, profile is the GPU instance profile eg. 3g.20gb.",
+            "gpu_instance_id", "compute_instance_id", "mig_index", "profile",
+        ),
+        smCount: newGPUDesc(gpuLabels,
+            "nvidia_mig_multiprocessor_count",
+            "Number of streaming multiprocessors of the MIG device.",
+            "gpu_instance_id", "compute_instance_id",
+        ),
+        engineCount: newGPUDesc(gpuLabels,
+            "nvidia_mig_engine_count",
+            "Number of engines of the MIG device. engine is copy, encoder, decoder, ofa or jpg.",
+            "gpu_instance_id", "compute_instance_id", "engine",
+        ),
+        memory: newGPUDesc(gpuLabels,
+            "nvidia_mig_memory_bytes",
+            "Frame buffer memory of the MIG device in bytes. state is total, reserved, used or free.",
+            "gpu_instance_id", "compute_instance_id", "state",
+        ),
+        bar1: newGPUDesc(gpuLabels,
+            "nvidia_mig_bar1_memory_bytes",
+            "BAR1 memory of the MIG device in bytes. state is total, used or free.",
+            "gpu_instance_id", "compute_instance_id", "state",
+        ),
+        eccErrors: newGPUDesc(gpuLabels,
+            "nvidia_mig_ecc_errors_total",
+            "ECC errors of the MIG device, labelled like nvidia_ecc_errors_total.",
+            "gpu_instance_id", "compute_instance_id", "scope", "bit", "location",
+        ),
+    }
+}
+
+func (m *migMetrics) describe(ch chan<- *prometheus.Desc) {
+    ch <- m.mode
+    ch <- m.info
+    ch <- m.smCount
+    ch <- m.engineCount
+    ch <- m.memory
+    ch <- m.bar1
+    ch <- m.eccErrors
+}
+
+func (m *migMetrics) collect(s gpuSink, gpu []string, GPU *NvidiaSmiGPU) {
+    s.gpuFlag(m.mode, gpu, "mig_mode.current_mig", GPU.MigMode.Current, "current")
+    s.gpuFlag(m.mode, gpu, "mig_mode.pending_mig", GPU.MigMode.Pending, "pending")
+
+    for i := range GPU.MigDevices.MigDevice {
+        d := &GPU.MigDevices.MigDevice[i]
+        gi, ci := strings.TrimSpace(d.GPUInstanceID), strings.TrimSpace(d.ComputeInstanceID)
+
+        info := append(append([]string{}, gpu...), gi, ci, strings.TrimSpace(d.Index), GPU.MigProfiles[gi])
+        gauge(s.ch, m.info, 1, info...)
+
+        field := "mig_devices.mig_device.device_attributes.shared."
+        shared := &d.DeviceAttributes.Shared
+        s.gpuGauge(m.smCount, gpu, field+"multiprocessor_count", shared.MultiprocessorCount, 1, gi, ci)
+        s.gpuGauge(m.engineCount, gpu, field+"copy_engine_count", shared.CopyEngineCount, 1, gi, ci, "copy")
+        s.gpuGauge(m.engineCount, gpu, field+"encoder_count", shared.EncoderCount, 1, gi, ci, "encoder")
+        s.gpuGauge(m.engineCount, gpu, field+"decoder_count", shared.DecoderCount, 1, gi, ci, "decoder")
+        s.gpuGauge(m.engineCount, gpu, field+"ofa_count", shared.OfaCount, 1, gi, ci, "ofa")
+        s.gpuGauge(m.engineCount, gpu, field+"jpg_count", shared.JpgCount, 1, gi, ci, "jpg")
+
+        field = "mig_devices.mig_device."
+        fb, bar1 := &d.FbMemoryUsage, &d.Bar1MemoryUsage
+        s.gpuGauge(m.memory, gpu, field+"fb_memory_usage.total", fb.Total, mebibyte, gi, ci, "total")
+        s.gpuGauge(m.memory, gpu, field+"fb_memory_usage.reserved", fb.Reserved, mebibyte, gi, ci, "reserved")
+        s.gpuGauge(m.memory, gpu, field+"fb_memory_usage.used", fb.Used, mebibyte, gi, ci, "used")
+        s.gpuGauge(m.memory, gpu, field+"fb_memory_usage.free", fb.Free, mebibyte, gi, ci, "free")
+        s.gpuGauge(m.bar1, gpu, field+"bar1_memory_usage.total", bar1.Total, mebibyte, gi, ci, "total")
+        s.gpuGauge(m.bar1, gpu, field+"bar1_memory_usage.used", bar1.Used, mebibyte, gi, ci, "used")
+        s.gpuGauge(m.bar1, gpu, field+"bar1_memory_usage.free", bar1.Free, mebibyte, gi, ci, "free")
+
+        s.gpuCounter(m.eccErrors, gpu, field+"ecc_error_count.volatile_count.sram_uncorrectable", d.EccErrorCount.VolatileCount.SramUncorrectable, gi, ci, "volatile", "double", "sram")
+    }
+}
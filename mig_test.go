@@ -0,0 +1,52 @@
+package main
+
+import (
+    "reflect"
+    "testing"
+)
+
+func TestParseMigProfiles(t *testing.T) {
+    tests := []struct {
+        out  string
+        want map[int]map[string]string
+    }{
+        {string(readTestdata(t, "mig-lgi.txt")), map[int]map[string]string{0: {"1": "3g.40gb", "2": "3g.40gb"}}},
+        {`+-------------------------------------------------------+
+| GPU instances:                                        |
+| GPU   Name             Profile  Instance   Placement  |
+|                          ID       ID       Start:Size |
+|=======================================================|
+|   0  MIG 1g.10gb         19        9          2:1     |
++-------------------------------------------------------+
+|   0  MIG 2g.20gb         14        3          4:2     |
++-------------------------------------------------------+
+|   1  MIG 7g.80gb          0        0          0:8     |
++-------------------------------------------------------+
+`, map[int]map[string]string{0: {"9": "1g.10gb", "3": "2g.20gb"}, 1: {"0": "7g.80gb"}}},
+        // the compute instance rows of mig -lci have an extra column
+        {`|   0      1       MIG 3g.40gb         2        0          0:3     |`, map[int]map[string]string{}},
+        {"No GPU instances found: Not Found\n", map[int]map[string]string{}},
+        {"No MIG-enabled devices found.\n", map[int]map[string]string{}},
+        {"", map[int]map[string]string{}},
+    }
+    for _, tt := range tests {
+        if got := parseMigProfiles([]byte(tt.out)); !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("parseMigProfiles(%q) = %v, want %v", tt.out, got, tt.want)
+        }
+    }
+}
+
+func TestMigMetrics(t *testing.T) {
+    // the A100 of q-x-535.xml has two MIG devices
+    c := newDumpCollector(t, "q-x-535.xml", CollectorOpts{})
+    c.migProfiles.profiles = parseMigProfiles(readTestdata(t, "mig-lgi.txt"))
+    testGolden(t, c, "q-x-535.mig.prom",
+        "nvidia_mig_mode",
+        "nvidia_mig_info",
+        "nvidia_mig_multiprocessor_count",
+        "nvidia_mig_engine_count",
+        "nvidia_mig_memory_bytes",
+        "nvidia_mig_bar1_memory_bytes",
+        "nvidia_mig_ecc_errors_total",
+    )
+}
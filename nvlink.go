@@ -0,0 +1,270 @@
+package main
+
+import (
+    "context"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/common/log"
+)
+
+/**
+//===================================================
+//================ NVLINK ===========================
+//===================================================
+*/
+
+// NvLink is one NVLink of a GPU, read from the text output of the
+// `nvidia-smi nvlink` subcommands as the XML has no NVLink section.
+type NvLink struct {
+    Link string
+    // Speed is eg. "25 GB/s", or "<inactive>" for a link that is down
+    Speed string
+    // Capabilities are keyed by capability, eg. p2p or sli
+    Capabilities map[string]string
+    // Errors are keyed by counter, eg. replay, recovery or crc
+    Errors map[string]string
+    // DataTx and DataRx are eg. "1234 KiB", not every GPU reports them
+    DataTx string
+    DataRx string
+}
+
+var (
+    nvLinkGPURegex  = regexp.MustCompile(`^GPU (\d+):(?:.*\(UUID: ([^)]+)\))?`)
+    nvLinkLineRegex = regexp.MustCompile(`^\s*Link (\d+)[:,]\s*(.*?)\s*$`)
+)
+
+// parseNvLinkOutput returns the line of each link of an nvlink subcommand
+// without the "Link N" prefix, keyed by GPU and link.
+//
+//  GPU 0: NVIDIA A100-SXM4-80GB (UUID: GPU-...)
+//       Link 0: 25 GB/s
+//       Link 0, P2P is supported: true
+//       Link 0: Replay Errors: 0
+func parseNvLinkOutput(out []byte) map[gpuRef]map[int][]string {
+    links := map[gpuRef]map[int][]string{}
+    var gpu map[int][]string
+    for _, line := range strings.Split(string(out), "\n") {
+        if m := nvLinkGPURegex.FindStringSubmatch(line); m != nil {
+            index, _ := strconv.Atoi(m[1])
+            gpu = map[int][]string{}
+            links[gpuRef{index: index, uuid: m[2]}] = gpu
+            continue
+        }
+        m := nvLinkLineRegex.FindStringSubmatch(line)
+        if m == nil || gpu == nil {
+            continue
+        }
+        link, _ := strconv.Atoi(m[1])
+        gpu[link] = append(gpu[link], m[2])
+    }
+    return links
+}
+
+// splitNvLinkLine splits "Replay Errors: 0" into a key such as replay and
+// the value, trimming any of suffixes from the key.
+func splitNvLinkLine(line string, suffixes ...string) (string, string, bool) {
+    i := strings.LastIndex(line, ":")
+    if i < 0 {
+        return "", "", false
+    }
+    key := strings.ToLower(strings.TrimSpace(line[:i]))
+    for _, suffix := range suffixes {
+        key = strings.TrimSuffix(key, suffix)
+    }
+    key = strings.Join(strings.Fields(key), "_")
+    return key, strings.TrimSpace(line[i+1:]), key != ""
+}
+
+// queryNvLinks runs `nvidia-smi nvlink --status` and returns the links keyed
+// by GPU. Capabilities, error counters and throughput are added from
+// their own subcommands when the driver supports them.
+func queryNvLinks(ctx context.Context, command string) (map[gpuRef][]NvLink, error) {
+    out, err := runCommand(ctx, command, "nvlink", "--status")
+    if err != nil {
+        return nil, err
+    }
+
+    byLink := map[gpuRef]map[int]*NvLink{}
+    for ref, gpuLinks := range parseNvLinkOutput(out) {
+        byLink[ref] = map[int]*NvLink{}
+        for link, lines := range gpuLinks {
+            byLink[ref][link] = &NvLink{
+                Link:         strconv.Itoa(link),
+                Speed:        lines[0],
+                Capabilities: map[string]string{},
+                Errors:       map[string]string{},
+            }
+        }
+    }
+
+    // each of these adds the "Link N" lines of a subcommand to the links
+    // from --status, lines of unknown links are ignored
+    optional := []struct {
+        args []string
+        add  func(l *NvLink, line string)
+    }{
+        {[]string{"nvlink", "--capabilities"}, func(l *NvLink, line string) {
+            if key, value, ok := splitNvLinkLine(line, " supported", " is"); ok {
+                l.Capabilities[key] = value
+            }
+        }},
+        {[]string{"nvlink", "--errorcounters"}, func(l *NvLink, line string) {
+            if key, value, ok := splitNvLinkLine(line, " errors"); ok {
+                l.Errors[key] = value
+            }
+        }},
+        {[]string{"nvlink", "-gt", "d"}, func(l *NvLink, line string) {
+            switch key, value, _ := splitNvLinkLine(line); key {
+            case "data_tx":
+                l.DataTx = value
+            case "data_rx":
+                l.DataRx = value
+            }
+        }},
+    }
+    for _, o := range optional {
+        out, err := runCommand(ctx, command, o.args...)
+        if err != nil {
+            if ctx.Err() != nil {
+                return nil, ctx.Err()
+            }
+            log.Debugf("cannot run %s %s: %v", command, strings.Join(o.args, " "), err)
+            continue
+        }
+        for ref, gpuLinks := range parseNvLinkOutput(out) {
+            for link, lines := range gpuLinks {
+                l := byLink[ref][link]
+                if l == nil {
+                    continue
+                }
+                for _, line := range lines {
+                    o.add(l, line)
+                }
+            }
+        }
+    }
+
+    links := map[gpuRef][]NvLink{}
+    for ref, gpuLinks := range byLink {
+        var gpu []NvLink
+        for _, l := range gpuLinks {
+            gpu = append(gpu, *l)
+        }
+        sort.Slice(gpu, func(i, j int) bool {
+            a, _ := strconv.Atoi(gpu[i].Link)
+            b, _ := strconv.Atoi(gpu[j].Link)
+            return a < b
+        })
+        links[ref] = gpu
+    }
+    return links, nil
+}
+
+// addNvLinks fills the NvLinks of each GPU, matched by the UUID nvlink
+// prints after each GPU.
+func (l *NvidiaSmiLog) addNvLinks(ctx context.Context, command string) {
+    links, err := queryNvLinks(ctx, command)
+    if err != nil {
+        log.Warnf("cannot query NVLinks: %v", err)
+        return
+    }
+    for ref, gpuLinks := range links {
+        if GPU := l.findGPU(ref); GPU != nil {
+            GPU.NvLinks = gpuLinks
+        }
+    }
+}
+
+// nvLinkUnits scale the speeds and byte counts of the nvlink subcommands
+var nvLinkUnits = map[string]float64{
+    "GB/s":   1e9,
+    "MB/s":   1e6,
+    "KiB":    kilobyte,
+    "KBytes": kilobyte,
+    "MiB":    mebibyte,
+}
+
+// nvLinkScale returns the scale of the unit raw ends with, 1 if unknown.
+func nvLinkScale(raw string) float64 {
+    f := strings.Fields(raw)
+    if len(f) == 0 {
+        return 1
+    }
+    if scale, ok := nvLinkUnits[f[len(f)-1]]; ok {
+        return scale
+    }
+    return 1
+}
+
+type nvLinkMetrics struct {
+    state      *prometheus.Desc
+    speed      *prometheus.Desc
+    capability *prometheus.Desc
+    errors     *prometheus.Desc
+    data       *prometheus.Desc
+}
+
+func newNvLinkMetrics(gpuLabels []string) *nvLinkMetrics {
+    return &nvLinkMetrics{
+        state: newGPUDesc(gpuLabels,
+            "nvidia_nvlink_state",
+            "Whether the NVLink is active (1) or inactive (0), with --collector.nvlink.",
+            "link",
+        ),
+        speed: newGPUDesc(gpuLabels,
+            "nvidia_nvlink_speed_bytes_per_second",
+            "Speed of an active NVLink in bytes per second, with --collector.nvlink.",
+            "link",
+        ),
+        capability: newGPUDesc(gpuLabels,
+            "nvidia_nvlink_capability",
+            "Whether an NVLink supports a capability (1) or not (0), eg. p2p, p2p_atomics or sli, with --collector.nvlink.",
+            "link", "capability",
+        ),
+        errors: newGPUDesc(gpuLabels,
+            "nvidia_nvlink_errors_total",
+            "NVLink error counters since the driver loaded or they were reset. type is eg. replay, recovery or crc, older drivers split crc into data_crc and flit_crc. With --collector.nvlink.",
+            "link", "type",
+        ),
+        data: newGPUDesc(gpuLabels,
+            "nvidia_nvlink_data_bytes_total",
+            "Data sent (tx) or received (rx) over an NVLink in bytes, where the driver supports throughput counters. With --collector.nvlink.",
+            "link", "direction",
+        ),
+    }
+}
+
+func (m *nvLinkMetrics) describe(ch chan<- *prometheus.Desc) {
+    ch <- m.state
+    ch <- m.speed
+    ch <- m.capability
+    ch <- m.errors
+    ch <- m.data
+}
+
+func (m *nvLinkMetrics) collect(s gpuSink, gpu []string, GPU *NvidiaSmiGPU) {
+    for _, l := range GPU.NvLinks {
+        active := !strings.Contains(strings.ToLower(l.Speed), "inactive")
+        gauge(s.ch, m.state, boolToFloat(active), append(append([]string{}, gpu...), l.Link)...)
+        if active {
+            s.gpuGauge(m.speed, gpu, "nvlink.speed", l.Speed, nvLinkScale(l.Speed), l.Link)
+        }
+
+        for capability, raw := range l.Capabilities {
+            s.gpuFlag(m.capability, gpu, "nvlink.capabilities."+capability, raw, l.Link, capability)
+        }
+        for counter, raw := range l.Errors {
+            s.gpuCounter(m.errors, gpu, "nvlink.errors."+counter, raw, l.Link, counter)
+        }
+        if l.DataTx != "" {
+            s.gpuValue(m.data, prometheus.CounterValue, gpu, "nvlink.data_tx", parseValue(l.DataTx), nvLinkScale(l.DataTx), l.Link, "tx")
+        }
+        if l.DataRx != "" {
+            s.gpuValue(m.data, prometheus.CounterValue, gpu, "nvlink.data_rx", parseValue(l.DataRx), nvLinkScale(l.DataRx), l.Link, "rx")
+        }
+    }
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+    "io/ioutil"
+    "path/filepath"
+    "reflect"
+    "testing"
+)
+
+const (
+    testUUID0 = "GPU-a8d4c5b2-3b1e-9f2c-7a6d-0e1f2a3b4c5d"
+    testUUID1 = "GPU-1f2e3d4c-5b6a-7988-a7b6-c5d4e3f2a1b0"
+)
+
+func readTestdata(t *testing.T, name string) []byte {
+    t.Helper()
+    out, err := ioutil.ReadFile(filepath.Join("testdata", name))
+    if err != nil {
+        t.Fatal(err)
+    }
+    return out
+}
+
+func TestParseNvLinkOutput(t *testing.T) {
+    tests := []struct {
+        file  string
+        gpu   gpuRef
+        link  int
+        lines []string
+    }{
+        {"nvlink-status.txt", gpuRef{0, testUUID0}, 0, []string{"25 GB/s"}},
+        {"nvlink-status.txt", gpuRef{0, testUUID0}, 3, []string{"<inactive>"}},
+        {"nvlink-status.txt", gpuRef{1, testUUID1}, 3, []string{"25 GB/s"}},
+        {"nvlink-capabilities.txt", gpuRef{1, testUUID1}, 1, []string{
+            "P2P is supported: true",
+            "Access to system memory supported: true",
+            "P2P atomics supported: true",
+            "System memory atomics supported: true",
+            "SLI is supported: true",
+            "Link is supported: false",
+        }},
+        {"nvlink-errorcounters.txt", gpuRef{1, testUUID1}, 1, []string{
+            "Replay Errors: 3",
+            "Recovery Errors: 0",
+            "CRC Errors: 7",
+        }},
+        {"nvlink-gt-d.txt", gpuRef{0, testUUID0}, 1, []string{
+            "Data Tx: 1001 KiB",
+            "Data Rx: 2001 KiB",
+        }},
+    }
+    for _, tt := range tests {
+        links := parseNvLinkOutput(readTestdata(t, tt.file))
+        if got := links[tt.gpu][tt.link]; !reflect.DeepEqual(got, tt.lines) {
+            t.Errorf("%s: GPU %v link %d = %q, want %q", tt.file, tt.gpu, tt.link, got, tt.lines)
+        }
+    }
+
+    links := parseNvLinkOutput(readTestdata(t, "nvlink-status.txt"))
+    if len(links) != 2 || len(links[gpuRef{0, testUUID0}]) != 4 || len(links[gpuRef{1, testUUID1}]) != 4 {
+        t.Errorf("nvlink-status.txt: got %v, want 2 GPUs with 4 links", links)
+    }
+}
+
+func TestParseNvLinkOutputWithoutUUID(t *testing.T) {
+    links := parseNvLinkOutput([]byte("GPU 2: Tesla V100-SXM2-16GB\n\t Link 0: 25.781 GB/s\n"))
+    want := map[gpuRef]map[int][]string{
+        {index: 2}: {0: {"25.781 GB/s"}},
+    }
+    if !reflect.DeepEqual(links, want) {
+        t.Errorf("got %v, want %v", links, want)
+    }
+}
+
+func TestSplitNvLinkLine(t *testing.T) {
+    tests := []struct {
+        line     string
+        suffixes []string
+        key      string
+        value    string
+        ok       bool
+    }{
+        {"P2P is supported: true", []string{" supported", " is"}, "p2p", "true", true},
+        {"Access to system memory supported: true", []string{" supported", " is"}, "access_to_system_memory", "true", true},
+        {"Link is supported: false", []string{" supported", " is"}, "link", "false", true},
+        {"Replay Errors: 3", []string{" errors"}, "replay", "3", true},
+        {"CRC Errors: 7", []string{" errors"}, "crc", "7", true},
+        {"Data Tx: 1001 KiB", nil, "data_tx", "1001 KiB", true},
+        {"25 GB/s", nil, "", "", false},
+        {": 1", nil, "", "1", false},
+    }
+    for _, tt := range tests {
+        key, value, ok := splitNvLinkLine(tt.line, tt.suffixes...)
+        if key != tt.key || value != tt.value || ok != tt.ok {
+            t.Errorf("splitNvLinkLine(%q) = %q %q %v, want %q %q %v", tt.line, key, value, ok, tt.key, tt.value, tt.ok)
+        }
+    }
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+/**
+//===================================================
+//================ PCIE =============================
+//===================================================
+*/
+
+// PCI is the <pci> section of a GPU.
+type PCI struct {
+    PCIBus string `xml:"pci_bus"`
+    PCIBusID string `xml:"pci_bus_id"`
+    LinkInfo struct {
+        PCIeGen struct {
+            MaxLinkGen string `xml:"max_link_gen"`
+            CurrentLinkGen string `xml:"current_link_gen"`
+            // newer drivers also report the device and host side
+            DeviceCurrentLinkGen string `xml:"device_current_link_gen"`
+            MaxDeviceLinkGen string `xml:"max_device_link_gen"`
+            MaxHostLinkGen string `xml:"max_host_link_gen"`
+        } `xml:"pcie_gen"`
+        LinkWidths struct {
+            MaxLinkWidth string `xml:"max_link_width"`
+            CurrentLinkWidth string `xml:"current_link_width"`
+        } `xml:"link_widths"`
+    } `xml:"pci_gpu_link_info"`
+    ReplayCounter string `xml:"replay_counter"`
+    ReplayRolloverCounter string `xml:"replay_rollover_counter"`
+    TxUtil string `xml:"tx_util"`
+    RxUtil string `xml:"rx_util"`
+}
+
+// nvidia-smi reports PCIe throughput in KB/s, NVML counts in units of 1024
+const kilobyte = 1024
+
+type pcieMetrics struct {
+    linkGen        *prometheus.Desc
+    linkWidth      *prometheus.Desc
+    replays        *prometheus.Desc
+    replayRollover *prometheus.Desc
+    throughput     *prometheus.Desc
+}
+
+func newPCIeMetrics(gpuLabels []string) *pcieMetrics {
+    return &pcieMetrics{
+        linkGen: newGPUDesc(gpuLabels,
+            "nvidia_pcie_link_gen",
+            "PCIe link generation. state is current or max for the link, device_current, device_max or host_max where the driver reports each side.",
+            "state",
+        ),
+        linkWidth: newGPUDesc(gpuLabels,
+            "nvidia_pcie_link_width",
+            "PCIe link width in lanes. state is current or max.",
+            "state",
+        ),
+        replays: newGPUDesc(gpuLabels,
+            "nvidia_pcie_replay_total",
+            "Number of PCIe replays, a rising count points to a bad link or riser.",
+        ),
+        replayRollover: newGPUDesc(gpuLabels,
+            "nvidia_pcie_replay_rollover_total",
+            "Number of times the PCIe replay counter rolled over.",
+        ),
+        throughput: newGPUDesc(gpuLabels,
+            "nvidia_pcie_throughput_bytes_per_second",
+            "PCIe throughput in bytes per second over the past sample period. direction is tx or rx.",
+            "direction",
+        ),
+    }
+}
+
+func (m *pcieMetrics) describe(ch chan<- *prometheus.Desc) {
+    ch <- m.linkGen
+    ch <- m.linkWidth
+    ch <- m.replays
+    ch <- m.replayRollover
+    ch <- m.throughput
+}
+
+func (m *pcieMetrics) collect(s gpuSink, gpu []string, GPU *NvidiaSmiGPU) {
+    gen := &GPU.PCI.LinkInfo.PCIeGen
+    field := "pci.pci_gpu_link_info.pcie_gen."
+    s.gpuGauge(m.linkGen, gpu, field+"current_link_gen", gen.CurrentLinkGen, 1, "current")
+    s.gpuGauge(m.linkGen, gpu, field+"max_link_gen", gen.MaxLinkGen, 1, "max")
+    s.gpuGauge(m.linkGen, gpu, field+"device_current_link_gen", gen.DeviceCurrentLinkGen, 1, "device_current")
+    s.gpuGauge(m.linkGen, gpu, field+"max_device_link_gen", gen.MaxDeviceLinkGen, 1, "device_max")
+    s.gpuGauge(m.linkGen, gpu, field+"max_host_link_gen", gen.MaxHostLinkGen, 1, "host_max")
+
+    widths := &GPU.PCI.LinkInfo.LinkWidths
+    field = "pci.pci_gpu_link_info.link_widths."
+    s.gpuGauge(m.linkWidth, gpu, field+"current_link_width", widths.CurrentLinkWidth, 1, "current")
+    s.gpuGauge(m.linkWidth, gpu, field+"max_link_width", widths.MaxLinkWidth, 1, "max")
+
+    s.gpuCounter(m.replays, gpu, "pci.replay_counter", GPU.PCI.ReplayCounter)
+    s.gpuCounter(m.replayRollover, gpu, "pci.replay_rollover_counter", GPU.PCI.ReplayRolloverCounter)
+
+    s.gpuGauge(m.throughput, gpu, "pci.tx_util", GPU.PCI.TxUtil, kilobyte, "tx")
+    s.gpuGauge(m.throughput, gpu, "pci.rx_util", GPU.PCI.RxUtil, kilobyte, "rx")
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestPCIeMetrics(t *testing.T) {
+    // only q-x-535.xml has the device and host link generations
+    for _, dump := range testDumps {
+        c := newDumpCollector(t, dump, CollectorOpts{})
+        testGolden(t, c, goldenName(dump, "pcie"),
+            "nvidia_pcie_link_gen",
+            "nvidia_pcie_link_width",
+            "nvidia_pcie_replay_total",
+            "nvidia_pcie_replay_rollover_total",
+            "nvidia_pcie_throughput_bytes_per_second",
+        )
+    }
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+    "context"
+    "sync"
+    "time"
+
+    "github.com/prometheus/common/log"
+)
+
+/**
+//===================================================
+//================ BACKGROUND POLLING ===============
+//===================================================
+*/
+
+// poller runs a query on a fixed interval and keeps the latest parsed
+// snapshot, so scrapes can be served without forking nvidia-smi.
+type poller struct {
+    query    func(ctx context.Context) (*NvidiaSmiLog, error)
+    interval time.Duration
+
+    mtx      sync.RWMutex
+    snapshot *NvidiaSmiLog
+    updated  time.Time
+    err      error
+}
+
+func newPoller(interval time.Duration, query func(ctx context.Context) (*NvidiaSmiLog, error)) *poller {
+    return &poller{
+        query:    query,
+        interval: interval,
+    }
+}
+
+// run polls until stop is closed. Each query may take at most one interval.
+func (p *poller) run(stop <-chan struct{}) {
+    ticker := time.NewTicker(p.interval)
+    defer ticker.Stop()
+
+    for {
+        p.poll()
+        select {
+        case <-ticker.C:
+        case <-stop:
+            return
+        }
+    }
+}
+
+func (p *poller) poll() {
+    ctx, cancel := context.WithTimeout(context.Background(), p.interval)
+    defer cancel()
+
+    snapshot, err := p.query(ctx)
+
+    p.mtx.Lock()
+    defer p.mtx.Unlock()
+    p.err = err
+    if err != nil {
+        log.Errorf("background poll failed: %v", err)
+        return
+    }
+    p.snapshot = snapshot
+    p.updated = time.Now()
+}
+
+// latest returns the last successful snapshot, when it was taken and the
+// error of the most recent poll. snapshot is nil until a poll succeeds.
+func (p *poller) latest() (snapshot *NvidiaSmiLog, updated time.Time, err error) {
+    p.mtx.RLock()
+    defer p.mtx.RUnlock()
+    return p.snapshot, p.updated, p.err
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+    "strings"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+/**
+//===================================================
+//================ POWER ============================
+//===================================================
+*/
+
+// PowerReadings is the <power_readings> section of a GPU. Newer drivers
+// split it into <gpu_power_readings> and <module_power_readings>, rename
+// power_limit to current_power_limit and may replace power_draw with
+// average_power_draw and instant_power_draw.
+type PowerReadings struct {
+    PowerState string `xml:"power_state"`
+    PowerManagement string `xml:"power_management"`
+    PowerDraw string `xml:"power_draw"`
+    AveragePowerDraw string `xml:"average_power_draw"`
+    InstantPowerDraw string `xml:"instant_power_draw"`
+    PowerLimit string `xml:"power_limit"`
+    CurrentPowerLimit string `xml:"current_power_limit"`
+    RequestedPowerLimit string `xml:"requested_power_limit"`
+    DefaultPowerLimit string `xml:"default_power_limit"`
+    EnforcedPowerLimit string `xml:"enforced_power_limit"`
+    MinPowerLimit string `xml:"min_power_limit"`
+    MaxPowerLimit string `xml:"max_power_limit"`
+}
+
+// draw returns the power draw and its element name, preferring the
+// instantaneous reading when the driver has no plain power_draw.
+func (p *PowerReadings) draw() (string, string) {
+    if p.PowerDraw != "" {
+        return "power_draw", p.PowerDraw
+    }
+    if p.InstantPowerDraw != "" {
+        return "instant_power_draw", p.InstantPowerDraw
+    }
+    return "average_power_draw", p.AveragePowerDraw
+}
+
+// limit returns the power limit and its element name.
+func (p *PowerReadings) limit() (string, string) {
+    if p.PowerLimit != "" {
+        return "power_limit", p.PowerLimit
+    }
+    return "current_power_limit", p.CurrentPowerLimit
+}
+
+// boardPower returns the readings for the whole board, the old layout
+// when the driver reports it and the GPU readings of the split layout
+// otherwise, with the section name.
+func (g *NvidiaSmiGPU) boardPower() (string, *PowerReadings) {
+    if g.PowerReadings != (PowerReadings{}) {
+        return "power_readings", &g.PowerReadings
+    }
+    return "gpu_power_readings", &g.GPUPowerReadings
+}
+
+// parsePState parses a performance state "P0" - "P15" as its number.
+func parsePState(raw string) smiValue {
+    v := strings.TrimSpace(raw)
+    if strings.HasPrefix(v, "P") {
+        return parseValue(v[1:])
+    }
+    return parseValue(v)
+}
+
+type powerMetrics struct {
+    power          *prometheus.Desc
+    powerLimit     *prometheus.Desc
+    readings       *prometheus.Desc
+    management     *prometheus.Desc
+    powerState     *prometheus.Desc
+    powerStateInfo *prometheus.Desc
+}
+
+func newPowerMetrics(gpuLabels []string) *powerMetrics {
+    return &powerMetrics{
+        power: newGPUDesc(gpuLabels,
+            "nvidia_power_watts",
+            "The last measured power draw for the entire board, in watts",
+        ),
+        powerLimit: newGPUDesc(gpuLabels,
+            "nvidia_power_limit_watts",
+            "The Limit power is set to in watts",
+        ),
+        readings: newGPUDesc(gpuLabels,
+            "nvidia_power_readings_watts",
+            "Power readings in watts. domain is board for drivers reporting power_readings, gpu or module for drivers splitting them. reading is draw, average_draw, instant_draw, limit, requested_limit, default_limit, enforced_limit, min_limit or max_limit.",
+            "domain", "reading",
+        ),
+        management: newGPUDesc(gpuLabels,
+            "nvidia_power_management",
+            "Whether power management and power limits are supported (1) or not (0).",
+        ),
+        powerState: newGPUDesc(gpuLabels,
+            "nvidia_power_state",
+            "Current performance state, from 0 (P0, maximum performance) to 15 (P15, minimum performance).",
+        ),
+        powerStateInfo: newGPUDesc(gpuLabels,
+            "nvidia_power_state_info",
+            "Current performance state as a label, eg. P0.",
+            "state",
+        ),
+    }
+}
+
+func (m *powerMetrics) describe(ch chan<- *prometheus.Desc) {
+    ch <- m.power
+    ch <- m.powerLimit
+    ch <- m.readings
+    ch <- m.management
+    ch <- m.powerState
+    ch <- m.powerStateInfo
+}
+
+func (m *powerMetrics) collect(s gpuSink, gpu []string, GPU *NvidiaSmiGPU) {
+    section, board := GPU.boardPower()
+    drawField, draw := board.draw()
+    limitField, limit := board.limit()
+    s.gpuGauge(m.power, gpu, section+"."+drawField, draw, 1)
+    s.gpuGauge(m.powerLimit, gpu, section+"."+limitField, limit, 1)
+    s.gpuFlag(m.management, gpu, section+".power_management", board.PowerManagement)
+
+    m.collectReadings(s, gpu, "power_readings", "board", &GPU.PowerReadings)
+    m.collectReadings(s, gpu, "gpu_power_readings", "gpu", &GPU.GPUPowerReadings)
+    m.collectReadings(s, gpu, "module_power_readings", "module", &GPU.ModulePowerReadings)
+
+    // performance_state is the same as power_state, older drivers only
+    // report it inside power_readings
+    field, state := "performance_state", GPU.PerformanceState
+    if state == "" {
+        field, state = section+".power_state", board.PowerState
+    }
+    v := parsePState(state)
+    s.gpuValue(m.powerState, prometheus.GaugeValue, gpu, field, v, 1)
+    if v.ok() {
+        gauge(s.ch, m.powerStateInfo, 1, append(append([]string{}, gpu...), strings.TrimSpace(state))...)
+    }
+}
+
+func (m *powerMetrics) collectReadings(s gpuSink, gpu []string, section string, domain string, p *PowerReadings) {
+    readings := []struct {
+        field   string
+        reading string
+        value   string
+    }{
+        {"power_draw", "draw", p.PowerDraw},
+        {"average_power_draw", "average_draw", p.AveragePowerDraw},
+        {"instant_power_draw", "instant_draw", p.InstantPowerDraw},
+        {"power_limit", "limit", p.PowerLimit},
+        {"current_power_limit", "limit", p.CurrentPowerLimit},
+        {"requested_power_limit", "requested_limit", p.RequestedPowerLimit},
+        {"default_power_limit", "default_limit", p.DefaultPowerLimit},
+        {"enforced_power_limit", "enforced_limit", p.EnforcedPowerLimit},
+        {"min_power_limit", "min_limit", p.MinPowerLimit},
+        {"max_power_limit", "max_limit", p.MaxPowerLimit},
+    }
+    for _, r := range readings {
+        s.gpuGauge(m.readings, gpu, section+"."+r.field, r.value, 1, domain, r.reading)
+    }
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestPowerMetrics(t *testing.T) {
+    // the board readings are power_readings in q-x-470.xml and
+    // gpu_power_readings in q-x-535.xml, where module_power_readings is N/A
+    for _, dump := range testDumps {
+        c := newDumpCollector(t, dump, CollectorOpts{})
+        testGolden(t, c, goldenName(dump, "power"),
+            "nvidia_power_watts",
+            "nvidia_power_limit_watts",
+            "nvidia_power_readings_watts",
+            "nvidia_power_management",
+            "nvidia_power_state",
+            "nvidia_power_state_info",
+        )
+    }
+}
@@ -0,0 +1,19 @@
+// +build !windows
+
+package main
+
+import (
+    "os/exec"
+    "syscall"
+)
+
+// setProcessGroup starts the command in its own process group so that
+// killProcessTree can signal the command and all of its children.
+func setProcessGroup(cmd *exec.Cmd) {
+    cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killProcessTree kills the process group started by setProcessGroup.
+func killProcessTree(cmd *exec.Cmd) error {
+    return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,22 @@
+// +build windows
+
+package main
+
+import (
+    "os/exec"
+    "strconv"
+)
+
+// setProcessGroup is a no-op on Windows, taskkill walks the process tree.
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+// killProcessTree kills the command and all of its children with taskkill,
+// falling back to killing only the command itself.
+func killProcessTree(cmd *exec.Cmd) error {
+    kill := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid))
+    if err := kill.Run(); err != nil {
+        return cmd.Process.Kill()
+    }
+    return nil
+}
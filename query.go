@@ -0,0 +1,251 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "math"
+    "regexp"
+    "strconv"
+    "strings"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/common/log"
+)
+
+/**
+//===================================================
+//================ QUERY FIELDS =====================
+//===================================================
+*/
+
+// queryField is a `nvidia-smi --query-gpu` field exported as its own
+// metric. Values are read with --format=csv,nounits, so they are in the
+// unit nvidia-smi lists for the field and multiplied by scale.
+type queryField struct {
+    name   string
+    metric string
+    help   string
+    scale  float64
+}
+
+// knownQueryFields name and scale the common numeric fields in the units
+// of the other metrics, eg. bytes and ratios. Other fields are exported
+// unscaled as nvidia_query_<field>. Both are only defaults, see
+// parseQueryFields.
+var knownQueryFields = map[string]queryField{
+    "fan.speed":                  {metric: "fan_speed_ratio", help: "Fan speed from 0 to 1.", scale: 0.01},
+    "memory.total":               {metric: "memory_total_bytes", help: "Total frame buffer memory in bytes.", scale: mebibyte},
+    "memory.reserved":            {metric: "memory_reserved_bytes", help: "Frame buffer memory reserved by the driver in bytes.", scale: mebibyte},
+    "memory.used":                {metric: "memory_used_bytes", help: "Used frame buffer memory in bytes.", scale: mebibyte},
+    "memory.free":                {metric: "memory_free_bytes", help: "Free frame buffer memory in bytes.", scale: mebibyte},
+    "utilization.gpu":            {metric: "utilization_gpu_ratio", help: "Time one or more kernels was executing on the GPU over the past sample period, from 0 to 1.", scale: 0.01},
+    "utilization.memory":         {metric: "utilization_memory_ratio", help: "Time memory was being read or written over the past sample period, from 0 to 1.", scale: 0.01},
+    "temperature.gpu":            {metric: "temperature_gpu_celsius", help: "GPU core temperature in Celsius.", scale: 1},
+    "temperature.memory":         {metric: "temperature_memory_celsius", help: "HBM memory temperature in Celsius.", scale: 1},
+    "power.draw":                 {metric: "power_draw_watts", help: "Power draw of the board in watts.", scale: 1},
+    "power.draw.average":         {metric: "power_draw_average_watts", help: "Average power draw of the board in watts.", scale: 1},
+    "power.draw.instant":         {metric: "power_draw_instant_watts", help: "Instant power draw of the board in watts.", scale: 1},
+    "power.limit":                {metric: "power_limit_watts", help: "Software power limit in watts.", scale: 1},
+    "enforced.power.limit":       {metric: "enforced_power_limit_watts", help: "Power limit enforced by the driver in watts.", scale: 1},
+    "clocks.current.graphics":    {metric: "clocks_current_graphics_mhz", help: "Current graphics clock in MHz.", scale: 1},
+    "clocks.current.sm":          {metric: "clocks_current_sm_mhz", help: "Current SM clock in MHz.", scale: 1},
+    "clocks.current.memory":      {metric: "clocks_current_memory_mhz", help: "Current memory clock in MHz.", scale: 1},
+    "clocks.current.video":       {metric: "clocks_current_video_mhz", help: "Current video clock in MHz.", scale: 1},
+    "pcie.link.gen.current":      {metric: "pcie_link_gen_current", help: "Current PCIe link generation.", scale: 1},
+    "pcie.link.width.current":    {metric: "pcie_link_width_current", help: "Current PCIe link width in lanes.", scale: 1},
+    "encoder.stats.sessionCount": {metric: "encoder_session_count", help: "Number of active encoder sessions.", scale: 1},
+}
+
+var (
+    queryFieldName    = regexp.MustCompile(`^[a-zA-Z0-9_.]+$`)
+    metricName        = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+    metricNameInvalid = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+)
+
+// parseQueryFields returns the metrics of --query-gpu field specs. A spec is
+// a field name optionally followed by the metric name, scale and help, eg.
+//
+//  power.draw
+//  memory.used=gpu_memory_used_bytes:1048576
+//  clocks.gr=gpu_graphics_clock_hertz:1e6:Graphics clock in Hz, from nvidia-smi.
+//
+// The metric name is used as is, parts left out or empty default to
+// knownQueryFields where it has the field. Empty specs are skipped.
+func parseQueryFields(specs []string) ([]queryField, error) {
+    var fields []queryField
+    seen := map[string]bool{}
+    metrics := map[string]string{}
+    for _, spec := range specs {
+        name, mapping := strings.TrimSpace(spec), ""
+        if i := strings.Index(name, "="); i >= 0 {
+            name, mapping = strings.TrimSpace(name[:i]), strings.TrimSpace(name[i+1:])
+        }
+        if name == "" && mapping == "" {
+            continue
+        }
+        if !queryFieldName.MatchString(name) {
+            return nil, fmt.Errorf("invalid field %q", name)
+        }
+        if name == "index" || name == "uuid" || seen[name] {
+            return nil, fmt.Errorf("field %q is given twice or always queried", name)
+        }
+        seen[name] = true
+
+        f, ok := knownQueryFields[name]
+        if !ok {
+            f = queryField{
+                metric: metricNameInvalid.ReplaceAllString(name, "_"),
+                help:   fmt.Sprintf("Value of the nvidia-smi --query-gpu field %s, in the unit nvidia-smi reports.", name),
+                scale:  1,
+            }
+        }
+        f.name = name
+        f.metric = "nvidia_query_" + f.metric
+        if err := f.setMapping(mapping); err != nil {
+            return nil, fmt.Errorf("field %q: %v", name, err)
+        }
+        if other, ok := metrics[f.metric]; ok {
+            return nil, fmt.Errorf("fields %q and %q are both exported as %s", other, name, f.metric)
+        }
+        metrics[f.metric] = name
+        fields = append(fields, f)
+    }
+    return fields, nil
+}
+
+// knownFields returns the fields the driver lists in help, see
+// queryHelp.known.
+func (h queryHelp) knownFields(fields []queryField) []queryField {
+    var names []string
+    for _, f := range fields {
+        names = append(names, f.name)
+    }
+    known := map[string]bool{}
+    for _, name := range h.known(names) {
+        known[name] = true
+    }
+    var result []queryField
+    for _, f := range fields {
+        if known[f.name] {
+            result = append(result, f)
+        }
+    }
+    return result
+}
+
+// setMapping overrides the defaults of f with the metric:scale:help of a
+// field spec, empty parts keep the default.
+func (f *queryField) setMapping(mapping string) error {
+    if mapping == "" {
+        return nil
+    }
+    parts := strings.SplitN(mapping, ":", 3)
+    if metric := strings.TrimSpace(parts[0]); metric != "" {
+        if !metricName.MatchString(metric) {
+            return fmt.Errorf("invalid metric name %q", metric)
+        }
+        f.metric = metric
+    }
+    if len(parts) > 1 && strings.TrimSpace(parts[1]) != "" {
+        scale, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+        if err != nil || scale == 0 || math.IsInf(scale, 0) || math.IsNaN(scale) {
+            return fmt.Errorf("invalid scale %q", parts[1])
+        }
+        f.scale = scale
+    }
+    if len(parts) > 2 && strings.TrimSpace(parts[2]) != "" {
+        f.help = strings.TrimSpace(parts[2])
+    }
+    return nil
+}
+
+// queryGPUFields runs `nvidia-smi --query-gpu=index,uuid,<fields>` and returns
+// the values of each GPU by field name. The csv header must name the fields
+// as help lists them.
+func queryGPUFields(ctx context.Context, command string, fields []queryField, help queryHelp) (map[gpuRef]map[string]string, error) {
+    names := []string{"index", "uuid"}
+    for _, f := range fields {
+        names = append(names, f.name)
+    }
+    out, err := runCommand(ctx, command, "--query-gpu="+strings.Join(names, ","), "--format=csv,nounits")
+    if err != nil {
+        return nil, err
+    }
+    header, _, rows, err := parseCSV(out)
+    if err == nil {
+        err = help.checkHeader(header, names)
+    }
+    if err != nil {
+        return nil, fmt.Errorf("cannot parse %s output: %v", command, err)
+    }
+
+    values, err := queryFieldRows(names, rows)
+    if err != nil {
+        return nil, fmt.Errorf("cannot parse %s output: %v", command, err)
+    }
+    return values, nil
+}
+
+// queryFieldRows returns the values of each row of --query-gpu=<names> by
+// field name, names must start with index,uuid. Columns are in query order,
+// the header is checked by queryGPUFields.
+func queryFieldRows(names []string, rows [][]string) (map[gpuRef]map[string]string, error) {
+    values := map[gpuRef]map[string]string{}
+    for _, row := range rows {
+        if len(row) != len(names) {
+            return nil, fmt.Errorf("%d columns, want %d", len(row), len(names))
+        }
+        index, err := strconv.Atoi(row[0])
+        if err != nil {
+            return nil, fmt.Errorf("no GPU index")
+        }
+        gpu := map[string]string{}
+        for i, name := range names {
+            gpu[name] = row[i]
+        }
+        values[gpuRef{index: index, uuid: row[1]}] = gpu
+    }
+    return values, nil
+}
+
+// addQueryFields fills the QueryFields of each GPU.
+func (l *NvidiaSmiLog) addQueryFields(ctx context.Context, command string, fields []queryField, help queryHelp) {
+    values, err := queryGPUFields(ctx, command, fields, help)
+    if err != nil {
+        log.Warnf("cannot query GPU fields: %v", err)
+        return
+    }
+    for ref, v := range values {
+        if GPU := l.findGPU(ref); GPU != nil {
+            GPU.QueryFields = v
+        }
+    }
+}
+
+type queryFieldMetrics struct {
+    fields []queryField
+    descs  []*prometheus.Desc
+}
+
+func newQueryFieldMetrics(gpuLabels []string, fields []queryField) *queryFieldMetrics {
+    m := &queryFieldMetrics{fields: fields}
+    for _, f := range fields {
+        m.descs = append(m.descs, newGPUDesc(gpuLabels, f.metric, f.help))
+    }
+    return m
+}
+
+func (m *queryFieldMetrics) describe(ch chan<- *prometheus.Desc) {
+    for _, desc := range m.descs {
+        ch <- desc
+    }
+}
+
+func (m *queryFieldMetrics) collect(s gpuSink, gpu []string, GPU *NvidiaSmiGPU) {
+    if GPU.QueryFields == nil {
+        return
+    }
+    for i, f := range m.fields {
+        s.gpuGauge(m.descs[i], gpu, "query."+f.name, GPU.QueryFields[f.name], f.scale)
+    }
+}
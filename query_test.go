@@ -0,0 +1,118 @@
+package main
+
+import (
+    "reflect"
+    "testing"
+)
+
+func TestParseQueryFields(t *testing.T) {
+    tests := []struct {
+        names   []string
+        metrics []string
+        scales  []float64
+        err     bool
+    }{
+        {[]string{"memory.used", " power.draw ", ""}, []string{"nvidia_query_memory_used_bytes", "nvidia_query_power_draw_watts"}, []float64{mebibyte, 1}, false},
+        {[]string{"clocks.gr", "clocks_event_reasons.active"}, []string{"nvidia_query_clocks_gr", "nvidia_query_clocks_event_reasons_active"}, []float64{1, 1}, false},
+        {[]string{""}, nil, nil, false},
+        {[]string{"memory.used", "memory.used"}, nil, nil, true},
+        {[]string{"index"}, nil, nil, true},
+        {[]string{"uuid"}, nil, nil, true},
+        {[]string{"memory.used;rm"}, nil, nil, true},
+        // both are exported as nvidia_query_a_b
+        {[]string{"a.b", "a_b"}, nil, nil, true},
+        {[]string{"fan.speed", "fan_speed_ratio"}, nil, nil, true},
+        // user supplied metric name, scale and help
+        {[]string{"memory.used=gpu_memory_used_bytes"}, []string{"gpu_memory_used_bytes"}, []float64{mebibyte}, false},
+        {[]string{"clocks.gr=gpu_graphics_clock_hertz:1e6:Graphics clock in Hz, from nvidia-smi: current."}, []string{"gpu_graphics_clock_hertz"}, []float64{1e6}, false},
+        {[]string{"power.draw=:0.001"}, []string{"nvidia_query_power_draw_watts"}, []float64{0.001}, false},
+        {[]string{"power.draw=power:"}, []string{"power"}, []float64{1}, false},
+        {[]string{"power.draw=nvidia-power"}, nil, nil, true},
+        {[]string{"power.draw=power:watts"}, nil, nil, true},
+        {[]string{"power.draw=power:0"}, nil, nil, true},
+        {[]string{"=power"}, nil, nil, true},
+        {[]string{"power.draw=power", "power.limit=power"}, nil, nil, true},
+        {[]string{"power.draw", "power.draw=power"}, nil, nil, true},
+    }
+    for _, tt := range tests {
+        fields, err := parseQueryFields(tt.names)
+        if (err != nil) != tt.err {
+            t.Errorf("parseQueryFields(%q) error %v, want error %v", tt.names, err, tt.err)
+            continue
+        }
+        var metrics []string
+        var scales []float64
+        for _, f := range fields {
+            metrics = append(metrics, f.metric)
+            scales = append(scales, f.scale)
+        }
+        if !reflect.DeepEqual(metrics, tt.metrics) || !reflect.DeepEqual(scales, tt.scales) {
+            t.Errorf("parseQueryFields(%q) = %q %v, want %q %v", tt.names, metrics, scales, tt.metrics, tt.scales)
+        }
+    }
+}
+
+func TestParseQueryFieldsHelp(t *testing.T) {
+    fields, err := parseQueryFields([]string{
+        "clocks.gr=:1e6:Graphics clock in Hz, from nvidia-smi: current.",
+        "memory.used=gpu_memory_used_bytes",
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    help := []string{fields[0].help, fields[1].help}
+    want := []string{"Graphics clock in Hz, from nvidia-smi: current.", knownQueryFields["memory.used"].help}
+    if !reflect.DeepEqual(help, want) {
+        t.Errorf("help %q, want %q", help, want)
+    }
+}
+
+func TestQueryFieldRows(t *testing.T) {
+    // the output of --query-gpu=index,uuid,name,fan.speed,memory.used,power.draw,clocks.gr,...
+    // where clocks.gr is printed as clocks.current.graphics
+    names := []string{"index", "uuid", "name", "fan.speed", "memory.used", "power.draw", "clocks.gr", "clocks_throttle_reasons.active", "retired_pages.pending"}
+    _, _, rows, err := parseCSV(readTestdata(t, "query-gpu.csv"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    values, err := queryFieldRows(names, rows)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        gpu   gpuRef
+        field string
+        value string
+    }{
+        {gpuRef{0, testUUID0}, "clocks.gr", "1410"},
+        {gpuRef{0, testUUID0}, "fan.speed", "[N/A]"},
+        {gpuRef{1, testUUID1}, "clocks.gr", "2520"},
+        {gpuRef{1, testUUID1}, "power.draw", "300.52"},
+        {gpuRef{1, testUUID1}, "retired_pages.pending", "[Not Supported]"},
+    }
+    for _, tt := range tests {
+        if got := values[tt.gpu][tt.field]; got != tt.value {
+            t.Errorf("GPU %v %s = %q, want %q", tt.gpu, tt.field, got, tt.value)
+        }
+    }
+
+    if _, err := queryFieldRows(names[:3], rows); err == nil {
+        t.Errorf("rows with more columns than fields did not fail")
+    }
+}
+
+func TestQueryHelpKnownFields(t *testing.T) {
+    help := parseQueryHelp(readTestdata(t, "help-query-gpu-470.txt"))
+    fields, err := parseQueryFields([]string{"memory.used", "temperature.memory", "clocks.gr"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    var names []string
+    for _, f := range help.knownFields(fields) {
+        names = append(names, f.name)
+    }
+    if want := []string{"memory.used", "clocks.gr"}; !reflect.DeepEqual(names, want) {
+        t.Errorf("knownFields = %q, want %q", names, want)
+    }
+}
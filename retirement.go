@@ -0,0 +1,130 @@
+package main
+
+import (
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+/**
+//===================================================
+//================ RETIRED PAGES / REMAPPED ROWS ====
+//===================================================
+*/
+
+// RetiredPages is the <retired_pages> section of a GPU. Pages with too
+// many ECC errors are retired (blacklisted) - a pending retirement takes
+// effect on the next GPU reset. Newer drivers renamed pending_blacklist to
+// pending_retirement.
+type RetiredPages struct {
+    MultipleSingleBitRetirement struct {
+        RetiredCount string `xml:"retired_count"`
+    } `xml:"multiple_single_bit_retirement"`
+    DoubleBitRetirement struct {
+        RetiredCount string `xml:"retired_count"`
+    } `xml:"double_bit_retirement"`
+    PendingBlacklist string `xml:"pending_blacklist"`
+    PendingRetirement string `xml:"pending_retirement"`
+}
+
+// RemappedRows is the <remapped_rows> section of Ampere and newer GPUs,
+// which remap memory rows instead of retiring pages.
+type RemappedRows struct {
+    Correctable string `xml:"remapped_row_corr"`
+    Uncorrectable string `xml:"remapped_row_unc"`
+    Pending string `xml:"remapped_row_pending"`
+    Failure string `xml:"remapped_row_failure"`
+    Histogram struct {
+        Max string `xml:"row_remapper_histogram_max"`
+        High string `xml:"row_remapper_histogram_high"`
+        Partial string `xml:"row_remapper_histogram_partial"`
+        Low string `xml:"row_remapper_histogram_low"`
+        None string `xml:"row_remapper_histogram_none"`
+    } `xml:"row_remapper_histogram"`
+}
+
+type retirementMetrics struct {
+    retiredPages      *prometheus.Desc
+    retiredPending    *prometheus.Desc
+    remappedRows      *prometheus.Desc
+    remapPending      *prometheus.Desc
+    remapFailure      *prometheus.Desc
+    remapAvailability *prometheus.Desc
+    resetRequired     *prometheus.Desc
+}
+
+func newRetirementMetrics(gpuLabels []string) *retirementMetrics {
+    return &retirementMetrics{
+        retiredPages: newGPUDesc(gpuLabels,
+            "nvidia_retired_pages",
+            "Number of memory pages retired, cause is multiple single bit or a double bit ECC error.",
+            "cause",
+        ),
+        retiredPending: newGPUDesc(gpuLabels,
+            "nvidia_retired_pages_pending",
+            "Whether a page is pending retirement, which takes effect on the next GPU reset.",
+        ),
+        remappedRows: newGPUDesc(gpuLabels,
+            "nvidia_remapped_rows",
+            "Number of memory rows remapped, type is the ECC error that caused the remapping.",
+            "type",
+        ),
+        remapPending: newGPUDesc(gpuLabels,
+            "nvidia_remapped_rows_pending",
+            "Whether a row remapping is pending, which takes effect on the next GPU reset.",
+        ),
+        remapFailure: newGPUDesc(gpuLabels,
+            "nvidia_remapped_rows_failure",
+            "Whether a row remapping has failed, the GPU should be replaced.",
+        ),
+        remapAvailability: newGPUDesc(gpuLabels,
+            "nvidia_remapped_rows_bank_availability",
+            "Row remapper histogram: number of memory banks by how many spare rows they have left (max, high, partial, low, none).",
+            "availability",
+        ),
+        resetRequired: newGPUDesc(gpuLabels,
+            "nvidia_reset_required",
+            "Whether a page retirement or row remapping is pending and the GPU needs a reset, drain the node before it is reset.",
+        ),
+    }
+}
+
+func (m *retirementMetrics) describe(ch chan<- *prometheus.Desc) {
+    ch <- m.retiredPages
+    ch <- m.retiredPending
+    ch <- m.remappedRows
+    ch <- m.remapPending
+    ch <- m.remapFailure
+    ch <- m.remapAvailability
+    ch <- m.resetRequired
+}
+
+func (m *retirementMetrics) collect(s gpuSink, gpu []string, GPU *NvidiaSmiGPU) {
+    pages := &GPU.RetiredPages
+    s.gpuGauge(m.retiredPages, gpu, "retired_pages.multiple_single_bit_retirement.retired_count", pages.MultipleSingleBitRetirement.RetiredCount, 1, "single_bit")
+    s.gpuGauge(m.retiredPages, gpu, "retired_pages.double_bit_retirement.retired_count", pages.DoubleBitRetirement.RetiredCount, 1, "double_bit")
+
+    pendingField, pendingRaw := "retired_pages.pending_retirement", pages.PendingRetirement
+    if pendingRaw == "" {
+        pendingField, pendingRaw = "retired_pages.pending_blacklist", pages.PendingBlacklist
+    }
+    s.gpuFlag(m.retiredPending, gpu, pendingField, pendingRaw)
+
+    rows := &GPU.RemappedRows
+    s.gpuGauge(m.remappedRows, gpu, "remapped_rows.remapped_row_corr", rows.Correctable, 1, "correctable")
+    s.gpuGauge(m.remappedRows, gpu, "remapped_rows.remapped_row_unc", rows.Uncorrectable, 1, "uncorrectable")
+    s.gpuFlag(m.remapPending, gpu, "remapped_rows.remapped_row_pending", rows.Pending)
+    s.gpuFlag(m.remapFailure, gpu, "remapped_rows.remapped_row_failure", rows.Failure)
+
+    field := "remapped_rows.row_remapper_histogram.row_remapper_histogram_"
+    s.gpuGauge(m.remapAvailability, gpu, field+"max", rows.Histogram.Max, 1, "max")
+    s.gpuGauge(m.remapAvailability, gpu, field+"high", rows.Histogram.High, 1, "high")
+    s.gpuGauge(m.remapAvailability, gpu, field+"partial", rows.Histogram.Partial, 1, "partial")
+    s.gpuGauge(m.remapAvailability, gpu, field+"low", rows.Histogram.Low, 1, "low")
+    s.gpuGauge(m.remapAvailability, gpu, field+"none", rows.Histogram.None, 1, "none")
+
+    // derived, reported when at least one of the pending flags is known
+    retirePending, remapPending := parseFlag(pendingRaw), parseFlag(rows.Pending)
+    if retirePending.ok() || remapPending.ok() {
+        reset := retirePending.ok() && retirePending.Value == 1 || remapPending.ok() && remapPending.Value == 1
+        gauge(s.ch, m.resetRequired, boolToFloat(reset), gpu...)
+    }
+}
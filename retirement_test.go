@@ -0,0 +1,22 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestRetirementMetrics(t *testing.T) {
+    // page retirement on the V100 of q-x-470.xml, row remapping on the A100
+    // of q-x-535.xml
+    for _, dump := range testDumps {
+        c := newDumpCollector(t, dump, CollectorOpts{})
+        testGolden(t, c, goldenName(dump, "retirement"),
+            "nvidia_retired_pages",
+            "nvidia_retired_pages_pending",
+            "nvidia_remapped_rows",
+            "nvidia_remapped_rows_pending",
+            "nvidia_remapped_rows_failure",
+            "nvidia_remapped_rows_bank_availability",
+            "nvidia_reset_required",
+        )
+    }
+}
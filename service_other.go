@@ -0,0 +1,17 @@
+// +build !windows
+
+package main
+
+/**
+//===================================================
+//================ SERVICE ==========================
+//===================================================
+*/
+
+/**
+* startService is a no-op outside of Windows - the exporter runs in the
+* foreground and is managed by the init system (systemd etc).
+*/
+func startService(stopCh chan<- bool) error {
+    return nil
+}
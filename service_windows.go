@@ -0,0 +1,80 @@
+// +build windows
+
+package main
+
+import (
+    "fmt"
+
+    "golang.org/x/sys/windows/svc"
+
+    "github.com/prometheus/common/log"
+)
+
+/**
+//===================================================
+//================ SERVICE ==========================
+//===================================================
+*/
+/*
+func initWbem() {
+    // This initialization prevents a memory leak on WMF 5+. See
+    // https://github.com/prometheus-community/windows_exporter/issues/77 and
+    // linked issues for details.
+    log.Debugf("Initializing SWbemServices")
+    s, err := wmi.InitializeSWbemServices(wmi.DefaultClient)
+    if err != nil {
+        log.Fatal(err)
+    }
+    wmi.DefaultClient.AllowMissingFields = true
+    wmi.DefaultClient.SWbemServicesClient = s
+}
+*/
+
+type exporterService struct {
+    stopCh chan<- bool
+}
+
+func (s *exporterService) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (ssec bool, errno uint32) {
+    const cmdsAccepted = svc.AcceptStop | svc.AcceptShutdown
+    changes <- svc.Status{State: svc.StartPending}
+    changes <- svc.Status{State: svc.Running, Accepts: cmdsAccepted}
+loop:
+    for {
+        select {
+        case c := <-r:
+            switch c.Cmd {
+            case svc.Interrogate:
+                changes <- c.CurrentStatus
+            case svc.Stop, svc.Shutdown:
+                s.stopCh <- true
+                break loop
+            default:
+                log.Error(fmt.Sprintf("unexpected control request #%d", c))
+            }
+        }
+    }
+    changes <- svc.Status{State: svc.StopPending}
+    return
+}
+
+/**
+* startService runs the exporter under the Windows service control manager
+* when it was not started from an interactive session.
+* stopCh receives true when the service is asked to stop.
+*/
+func startService(stopCh chan<- bool) error {
+    isInteractive, err := svc.IsAnInteractiveSession()
+    if err != nil {
+        return err
+    }
+
+    if !isInteractive {
+        go func() {
+            err := svc.Run(SERVICE_NAME, &exporterService{stopCh: stopCh})
+            if err != nil {
+                log.Errorf("Failed to start service: %v", err)
+            }
+        }()
+    }
+    return nil
+}
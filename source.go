@@ -0,0 +1,69 @@
+package main
+
+import (
+    "context"
+    "encoding/xml"
+    "fmt"
+)
+
+/**
+//===================================================
+//================ GPU SOURCES ======================
+//===================================================
+*/
+
+// GPUSource queries the GPUs and returns a snapshot normalised to the model
+// of the nvidia-smi XML dump, so each metric is written once whatever the
+// source. Readings are strings as nvidia-smi prints them, a number with an
+// optional unit or one of N/A, [Not Supported], ... and are parsed by
+// parseValue. A source leaves the fields it cannot read empty.
+type GPUSource interface {
+    Query(ctx context.Context) (*NvidiaSmiLog, error)
+}
+
+// newGPUSource returns the source selected by opts.Source.
+func newGPUSource(opts CollectorOpts) (GPUSource, error) {
+    switch opts.Source {
+    case "", "xml":
+        return &xmlSource{command: opts.Command, flags: opts.Flags}, nil
+    case "csv":
+        return newCSVSource(opts.Command), nil
+    case "nvml":
+        return newNVMLSource()
+    }
+    return nil, fmt.Errorf("unknown source %q, must be xml, csv or nvml", opts.Source)
+}
+
+// xmlSource parses the `nvidia-smi -q -x` dump, the most complete source.
+type xmlSource struct {
+    command string
+    flags   []string
+}
+
+func (s *xmlSource) Query(ctx context.Context) (*NvidiaSmiLog, error) {
+    // Execute system command - unpack the array of flags
+    stdout, err := runCommand(ctx, s.command, s.flags...)
+    if err != nil {
+        return nil, err
+    }
+
+    xmlData, err := parseNvidiaSmiLog(stdout)
+    if err != nil {
+        return nil, fmt.Errorf("cannot parse %s output: %v", s.command, err)
+    }
+    return xmlData, nil
+}
+
+// parseNvidiaSmiLog parses a -q -x dump.
+func parseNvidiaSmiLog(out []byte) (*NvidiaSmiLog, error) {
+    var xmlData NvidiaSmiLog
+    if err := xml.Unmarshal(out, &xmlData); err != nil {
+        return nil, err
+    }
+
+    // SANITY CHECK results
+    if xmlData.DriverVersion == "" {
+        return nil, fmt.Errorf("Nvidia DriverVersion not parsed correctly")
+    }
+    return &xmlData, nil
+}
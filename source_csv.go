@@ -0,0 +1,344 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/csv"
+    "encoding/xml"
+    "fmt"
+    "regexp"
+    "strings"
+    "time"
+
+    "github.com/prometheus/common/log"
+)
+
+/**
+//===================================================
+//================ CSV SOURCE =======================
+//===================================================
+*/
+
+// csvUnitSuffix is the unit nvidia-smi appends to csv header names, eg.
+// "memory.used [MiB]", also with nounits.
+var csvUnitSuffix = regexp.MustCompile(`\s*\[([^\]]*)\]$`)
+
+// parseCSV parses `--format=csv` output into the header names, the unit of
+// each column, "" when it has none, and the rows. Values keep whatever
+// nvidia-smi printed, eg. "[Not Supported]".
+func parseCSV(out []byte) ([]string, []string, [][]string, error) {
+    r := csv.NewReader(bytes.NewReader(out))
+    r.TrimLeadingSpace = true
+    records, err := r.ReadAll()
+    if err != nil {
+        return nil, nil, nil, err
+    }
+    if len(records) == 0 {
+        return nil, nil, nil, fmt.Errorf("no csv header")
+    }
+    header := records[0]
+    units := make([]string, len(header))
+    for i := range header {
+        header[i] = strings.TrimSpace(header[i])
+        if m := csvUnitSuffix.FindStringSubmatch(header[i]); m != nil {
+            header[i], units[i] = strings.TrimSuffix(header[i], m[0]), m[1]
+        }
+    }
+    rows := records[1:]
+    for _, row := range rows {
+        for i := range row {
+            row[i] = strings.TrimSpace(row[i])
+        }
+    }
+    return header, units, rows, nil
+}
+
+// queryHelp maps the field names and aliases listed by `nvidia-smi
+// --help-query-gpu` or --help-query-compute-apps to the name printed in the
+// csv header, the first name of each entry:
+//
+//  "clocks.current.graphics" or "clocks.gr"
+//  Current frequency of graphics (shader) clock.
+//
+// A nil queryHelp knows no fields, see probeQueryHelp.
+type queryHelp map[string]string
+
+var (
+    queryHelpEntry = regexp.MustCompile(`^"[\w.]+"(\s+or\s+"[\w.]+")*$`)
+    queryHelpName  = regexp.MustCompile(`"([\w.]+)"`)
+)
+
+func parseQueryHelp(out []byte) queryHelp {
+    help := queryHelp{}
+    for _, line := range strings.Split(string(out), "\n") {
+        line = strings.TrimSpace(line)
+        if !queryHelpEntry.MatchString(line) {
+            continue
+        }
+        names := queryHelpName.FindAllStringSubmatch(line, -1)
+        for _, name := range names {
+            help[name[1]] = names[0][1]
+        }
+    }
+    return help
+}
+
+// probeTimeout bounds the nvidia-smi --help-query-* runs at startup.
+const probeTimeout = 30 * time.Second
+
+// probeQueryHelp runs `nvidia-smi <flag>`, eg. --help-query-gpu, once at
+// startup to learn the fields the driver knows. On failure it warns and
+// returns nil, the queries then keep every field.
+func probeQueryHelp(command string, flag string) queryHelp {
+    ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+    defer cancel()
+    out, err := runCommand(ctx, command, flag)
+    if err != nil {
+        log.Warnf("cannot list the fields the driver knows, querying them all: %v", err)
+        return nil
+    }
+    return parseQueryHelp(out)
+}
+
+// known returns the fields the driver knows, warning about the others. A
+// driver fails the whole query on a single unknown field, eg.
+// temperature.memory or mig.mode.current on older drivers.
+func (h queryHelp) known(fields []string) []string {
+    if h == nil {
+        return fields
+    }
+    var known, unknown []string
+    for _, f := range fields {
+        if _, ok := h[f]; ok {
+            known = append(known, f)
+        } else {
+            unknown = append(unknown, f)
+        }
+    }
+    if len(unknown) > 0 {
+        log.Warnf("leaving out the query fields %s, the driver does not know them", strings.Join(unknown, ","))
+    }
+    return known
+}
+
+// checkHeader fails when a csv header does not name fields in query order,
+// under their header names. Without help only the column count is checked.
+func (h queryHelp) checkHeader(header []string, fields []string) error {
+    if len(header) != len(fields) {
+        return fmt.Errorf("%d columns, want %d", len(header), len(fields))
+    }
+    if h == nil {
+        return nil
+    }
+    for i, f := range fields {
+        want, ok := h[f]
+        if !ok {
+            want = f
+        }
+        if header[i] != want {
+            return fmt.Errorf("column %d is %s, want %s for the field %s", i+1, header[i], want, f)
+        }
+    }
+    return nil
+}
+
+// csvGPUFields are the --query-gpu fields of the csv source and the
+// NvidiaSmiGPU reading each fills. With nounits the values are in the
+// units of the XML dump, eg. MiB, W and MHz.
+var csvGPUFields = []struct {
+    name  string
+    field func(g *NvidiaSmiGPU) *string
+}{
+    {"name", func(g *NvidiaSmiGPU) *string { return &g.ProductName }},
+    {"uuid", func(g *NvidiaSmiGPU) *string { return &g.UUID }},
+    {"serial", func(g *NvidiaSmiGPU) *string { return &g.Serial }},
+    {"pci.bus_id", func(g *NvidiaSmiGPU) *string { return &g.PCI.PCIBusID }},
+    {"vbios_version", func(g *NvidiaSmiGPU) *string { return &g.VBiosVersion }},
+    {"fan.speed", func(g *NvidiaSmiGPU) *string { return &g.FanSpeed }},
+    {"pstate", func(g *NvidiaSmiGPU) *string { return &g.PerformanceState }},
+    {"memory.total", func(g *NvidiaSmiGPU) *string { return &g.FbMemoryUsage.Total }},
+    {"memory.used", func(g *NvidiaSmiGPU) *string { return &g.FbMemoryUsage.Used }},
+    {"memory.free", func(g *NvidiaSmiGPU) *string { return &g.FbMemoryUsage.Free }},
+    {"utilization.gpu", func(g *NvidiaSmiGPU) *string { return &g.Utilization.GPUUtil }},
+    {"utilization.memory", func(g *NvidiaSmiGPU) *string { return &g.Utilization.MemoryUtil }},
+    {"encoder.stats.sessionCount", func(g *NvidiaSmiGPU) *string { return &g.EncoderStats.SessionCount }},
+    {"encoder.stats.averageFps", func(g *NvidiaSmiGPU) *string { return &g.EncoderStats.AverageFps }},
+    {"encoder.stats.averageLatency", func(g *NvidiaSmiGPU) *string { return &g.EncoderStats.AverageLatency }},
+    {"temperature.gpu", func(g *NvidiaSmiGPU) *string { return &g.Temperature.GPUTemp }},
+    {"temperature.memory", func(g *NvidiaSmiGPU) *string { return &g.Temperature.MemoryTemp }},
+    {"power.management", func(g *NvidiaSmiGPU) *string { return &g.PowerReadings.PowerManagement }},
+    {"power.draw", func(g *NvidiaSmiGPU) *string { return &g.PowerReadings.PowerDraw }},
+    {"power.limit", func(g *NvidiaSmiGPU) *string { return &g.PowerReadings.PowerLimit }},
+    {"enforced.power.limit", func(g *NvidiaSmiGPU) *string { return &g.PowerReadings.EnforcedPowerLimit }},
+    {"power.default_limit", func(g *NvidiaSmiGPU) *string { return &g.PowerReadings.DefaultPowerLimit }},
+    {"power.min_limit", func(g *NvidiaSmiGPU) *string { return &g.PowerReadings.MinPowerLimit }},
+    {"power.max_limit", func(g *NvidiaSmiGPU) *string { return &g.PowerReadings.MaxPowerLimit }},
+    {"clocks.current.graphics", func(g *NvidiaSmiGPU) *string { return &g.Clocks.GraphicsClock }},
+    {"clocks.current.sm", func(g *NvidiaSmiGPU) *string { return &g.Clocks.SmClock }},
+    {"clocks.current.memory", func(g *NvidiaSmiGPU) *string { return &g.Clocks.MemClock }},
+    {"clocks.current.video", func(g *NvidiaSmiGPU) *string { return &g.Clocks.VideoClock }},
+    {"clocks.applications.graphics", func(g *NvidiaSmiGPU) *string { return &g.ApplicationsClocks.GraphicsClock }},
+    {"clocks.applications.memory", func(g *NvidiaSmiGPU) *string { return &g.ApplicationsClocks.MemClock }},
+    {"clocks.default_applications.graphics", func(g *NvidiaSmiGPU) *string { return &g.DefaultApplicationsClocks.GraphicsClock }},
+    {"clocks.default_applications.memory", func(g *NvidiaSmiGPU) *string { return &g.DefaultApplicationsClocks.MemClock }},
+    {"clocks.max.graphics", func(g *NvidiaSmiGPU) *string { return &g.MaxClocks.GraphicsClock }},
+    {"clocks.max.sm", func(g *NvidiaSmiGPU) *string { return &g.MaxClocks.SmClock }},
+    {"clocks.max.memory", func(g *NvidiaSmiGPU) *string { return &g.MaxClocks.MemClock }},
+    {"pcie.link.gen.current", func(g *NvidiaSmiGPU) *string { return &g.PCI.LinkInfo.PCIeGen.CurrentLinkGen }},
+    {"pcie.link.gen.max", func(g *NvidiaSmiGPU) *string { return &g.PCI.LinkInfo.PCIeGen.MaxLinkGen }},
+    {"pcie.link.width.current", func(g *NvidiaSmiGPU) *string { return &g.PCI.LinkInfo.LinkWidths.CurrentLinkWidth }},
+    {"pcie.link.width.max", func(g *NvidiaSmiGPU) *string { return &g.PCI.LinkInfo.LinkWidths.MaxLinkWidth }},
+    {"ecc.mode.current", func(g *NvidiaSmiGPU) *string { return &g.EccMode.Current }},
+    {"ecc.mode.pending", func(g *NvidiaSmiGPU) *string { return &g.EccMode.Pending }},
+    {"retired_pages.single_bit_ecc.count", func(g *NvidiaSmiGPU) *string { return &g.RetiredPages.MultipleSingleBitRetirement.RetiredCount }},
+    {"retired_pages.double_bit.count", func(g *NvidiaSmiGPU) *string { return &g.RetiredPages.DoubleBitRetirement.RetiredCount }},
+    {"retired_pages.pending", func(g *NvidiaSmiGPU) *string { return &g.RetiredPages.PendingRetirement }},
+    {"mig.mode.current", func(g *NvidiaSmiGPU) *string { return &g.MigMode.Current }},
+    {"mig.mode.pending", func(g *NvidiaSmiGPU) *string { return &g.MigMode.Pending }},
+    {"total_energy_consumption", func(g *NvidiaSmiGPU) *string { return &g.TotalEnergyConsumption }},
+}
+
+// csvThrottleReasons are queried as clocks_throttle_reasons.<reason> and
+// added as the XML element clocks_throttle_reason_<reason>.
+var csvThrottleReasons = []string{
+    "gpu_idle",
+    "applications_clocks_setting",
+    "sw_power_cap",
+    "hw_slowdown",
+    "hw_thermal_slowdown",
+    "hw_power_brake_slowdown",
+    "sw_thermal_slowdown",
+    "sync_boost",
+}
+
+// csvSource runs `nvidia-smi --query-gpu`, much cheaper than the XML dump
+// but without MIG devices, ECC error counts, remapped rows and a few other
+// sections. Processes come from `--query-compute-apps`, compute only.
+type csvSource struct {
+    command string
+    // fields are the --query-gpu fields the driver knows
+    fields   []string
+    help     queryHelp
+    appsHelp queryHelp
+}
+
+// csvAppFields are the --query-compute-apps fields of addProcesses.
+var csvAppFields = []string{"gpu_uuid", "pid", "process_name", "used_memory"}
+
+// newCSVSource probes the fields the driver knows, so a field added in a
+// later driver leaves out one reading rather than failing every query.
+func newCSVSource(command string) *csvSource {
+    s := &csvSource{
+        command:  command,
+        help:     probeQueryHelp(command, "--help-query-gpu"),
+        appsHelp: probeQueryHelp(command, "--help-query-compute-apps"),
+    }
+    fields := []string{"driver_version", "count"}
+    for _, f := range csvGPUFields {
+        fields = append(fields, f.name)
+    }
+    for _, reason := range csvThrottleReasons {
+        fields = append(fields, "clocks_throttle_reasons."+reason)
+    }
+    s.fields = s.help.known(fields)
+    return s
+}
+
+func (s *csvSource) Query(ctx context.Context) (*NvidiaSmiLog, error) {
+    out, err := runCommand(ctx, s.command, "--query-gpu="+strings.Join(s.fields, ","), "--format=csv,nounits")
+    if err != nil {
+        return nil, err
+    }
+    header, units, rows, err := parseCSV(out)
+    if err == nil {
+        err = s.help.checkHeader(header, s.fields)
+    }
+    if err != nil {
+        return nil, fmt.Errorf("cannot parse %s output: %v", s.command, err)
+    }
+
+    // columns are in query order, the fields the driver does not know are
+    // left empty. Numbers get the unit of their column back, like the
+    // readings of the XML dump, eg. total_energy_consumption is in mJ or J
+    // depending on the driver.
+    columns := map[string]int{}
+    for i, f := range s.fields {
+        columns[f] = i
+    }
+    value := func(row []string, field string) string {
+        i, ok := columns[field]
+        if !ok {
+            return ""
+        }
+        if units[i] != "" && parseValue(row[i]).ok() && !strings.HasPrefix(row[i], "0x") {
+            return row[i] + " " + units[i]
+        }
+        return row[i]
+    }
+
+    var l NvidiaSmiLog
+    for _, row := range rows {
+        if len(row) != len(s.fields) {
+            return nil, fmt.Errorf("cannot parse %s output: %d columns, want %d", s.command, len(row), len(s.fields))
+        }
+        l.DriverVersion, l.AttachedGPUs = value(row, "driver_version"), value(row, "count")
+
+        g := NvidiaSmiGPU{}
+        for _, f := range csvGPUFields {
+            *f.field(&g) = value(row, f.name)
+        }
+        for _, reason := range csvThrottleReasons {
+            g.ClocksThrottleReasons.Reasons = append(g.ClocksThrottleReasons.Reasons, ClockReason{
+                XMLName: xml.Name{Local: "clocks_throttle_reason_" + reason},
+                Value:   value(row, "clocks_throttle_reasons."+reason),
+            })
+        }
+        l.GPUs = append(l.GPUs, g)
+    }
+
+    // SANITY CHECK results
+    if l.DriverVersion == "" {
+        return nil, fmt.Errorf("Nvidia DriverVersion not parsed correctly")
+    }
+
+    if err := s.addProcesses(ctx, &l); err != nil {
+        if ctx.Err() != nil {
+            return nil, ctx.Err()
+        }
+        log.Warnf("cannot list GPU processes: %v", err)
+    }
+    return &l, nil
+}
+
+// addProcesses adds the compute processes of each GPU, matched by UUID.
+func (s *csvSource) addProcesses(ctx context.Context, l *NvidiaSmiLog) error {
+    out, err := runCommand(ctx, s.command, "--query-compute-apps="+strings.Join(csvAppFields, ","), "--format=csv,nounits")
+    if err != nil {
+        return err
+    }
+    header, _, rows, err := parseCSV(out)
+    if err != nil {
+        return err
+    }
+    // the used_memory header is used_gpu_memory
+    if err := s.appsHelp.checkHeader(header, csvAppFields); err != nil {
+        return err
+    }
+    for _, row := range rows {
+        if len(row) != len(csvAppFields) {
+            return fmt.Errorf("%d columns, want %d", len(row), len(csvAppFields))
+        }
+        for i := range l.GPUs {
+            if l.GPUs[i].UUID != row[0] {
+                continue
+            }
+            l.GPUs[i].Processes.ProcessInfo = append(l.GPUs[i].Processes.ProcessInfo, ProcessInfo{
+                PID:         row[1],
+                ProcessName: row[2],
+                UsedMemory:  row[3],
+                Type:        "C",
+            })
+        }
+    }
+    return nil
+}
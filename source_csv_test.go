@@ -0,0 +1,134 @@
+package main
+
+import (
+    "reflect"
+    "testing"
+)
+
+func TestParseCSV(t *testing.T) {
+    tests := []struct {
+        file   string
+        header []string
+        units  []string
+        rows   [][]string
+    }{
+        {"query-gpu.csv",
+            []string{"index", "uuid", "name", "fan.speed", "memory.used", "power.draw", "clocks.current.graphics", "clocks_throttle_reasons.active", "retired_pages.pending"},
+            []string{"", "", "", "%", "MiB", "W", "MHz", "", ""},
+            [][]string{
+                {"0", testUUID0, "NVIDIA A100-SXM4-80GB", "[N/A]", "4", "61.50", "1410", "0x0000000000000001", "No"},
+                {"1", testUUID1, "NVIDIA GeForce RTX 4090", "30", "1024", "300.52", "2520", "0x0000000000000000", "[Not Supported]"},
+            },
+        },
+        // the header of used_memory is used_gpu_memory
+        {"query-compute-apps.csv",
+            []string{"gpu_uuid", "pid", "process_name", "used_gpu_memory"},
+            []string{"", "", "", "MiB"},
+            [][]string{
+                {testUUID0, "28459", "/usr/bin/python3", "2048"},
+                {testUUID1, "1201", "/opt/app/bin/render worker", "512"},
+            },
+        },
+        {"query-compute-apps-none.csv",
+            []string{"gpu_uuid", "pid", "process_name", "used_gpu_memory"},
+            []string{"", "", "", "MiB"},
+            [][]string{},
+        },
+    }
+    for _, tt := range tests {
+        header, units, rows, err := parseCSV(readTestdata(t, tt.file))
+        if err != nil {
+            t.Errorf("%s: %v", tt.file, err)
+            continue
+        }
+        if !reflect.DeepEqual(header, tt.header) {
+            t.Errorf("%s: header %q, want %q", tt.file, header, tt.header)
+        }
+        if !reflect.DeepEqual(units, tt.units) {
+            t.Errorf("%s: units %q, want %q", tt.file, units, tt.units)
+        }
+        if !reflect.DeepEqual(rows, tt.rows) {
+            t.Errorf("%s: rows %q, want %q", tt.file, rows, tt.rows)
+        }
+    }
+}
+
+func TestParseCSVErrors(t *testing.T) {
+    for _, out := range []string{
+        "",
+        "index, uuid\n0\n",
+        "index, name\n0, \"NVIDIA\n",
+    } {
+        if _, _, _, err := parseCSV([]byte(out)); err == nil {
+            t.Errorf("parseCSV(%q) did not fail", out)
+        }
+    }
+}
+
+func TestParseQueryHelp(t *testing.T) {
+    tests := []struct {
+        file   string
+        field  string
+        header string
+        known  bool
+    }{
+        {"help-query-gpu.txt", "clocks.gr", "clocks.current.graphics", true},
+        {"help-query-gpu.txt", "clocks.current.graphics", "clocks.current.graphics", true},
+        {"help-query-gpu.txt", "clocks_throttle_reasons.sw_power_cap", "clocks_event_reasons.sw_power_cap", true},
+        {"help-query-gpu.txt", "temperature.memory", "temperature.memory", true},
+        {"help-query-gpu-470.txt", "clocks_throttle_reasons.sw_power_cap", "clocks_throttle_reasons.sw_power_cap", true},
+        {"help-query-gpu-470.txt", "clocks_event_reasons.sw_power_cap", "", false},
+        {"help-query-gpu-470.txt", "temperature.memory", "", false},
+        {"help-query-compute-apps.txt", "used_memory", "used_gpu_memory", true},
+        // not fields: section titles and quotes in descriptions
+        {"help-query-gpu.txt", "YYYY/MM/DD HH:MM:SS.msec", "", false},
+        {"help-query-gpu.txt", "Enabled", "", false},
+    }
+    for _, tt := range tests {
+        help := parseQueryHelp(readTestdata(t, tt.file))
+        header, ok := help[tt.field]
+        if header != tt.header || ok != tt.known {
+            t.Errorf("%s: %s = %q %v, want %q %v", tt.file, tt.field, header, ok, tt.header, tt.known)
+        }
+    }
+}
+
+func TestQueryHelpKnown(t *testing.T) {
+    help := parseQueryHelp(readTestdata(t, "help-query-gpu-470.txt"))
+    fields := []string{"driver_version", "temperature.gpu", "temperature.memory", "clocks_throttle_reasons.gpu_idle", "mig.mode.current"}
+    want := []string{"driver_version", "temperature.gpu", "clocks_throttle_reasons.gpu_idle", "mig.mode.current"}
+    if got := help.known(fields); !reflect.DeepEqual(got, want) {
+        t.Errorf("known(%q) = %q, want %q", fields, got, want)
+    }
+    // without help every field is queried
+    if got := queryHelp(nil).known(fields); !reflect.DeepEqual(got, fields) {
+        t.Errorf("nil help known(%q) = %q, want all", fields, got)
+    }
+}
+
+func TestQueryHelpCheckHeader(t *testing.T) {
+    help := parseQueryHelp(readTestdata(t, "help-query-gpu-470.txt"))
+    header, _, _, err := parseCSV(readTestdata(t, "query-gpu.csv"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    tests := []struct {
+        help   queryHelp
+        fields []string
+        err    bool
+    }{
+        {help, []string{"index", "uuid", "name", "fan.speed", "memory.used", "power.draw", "clocks.gr", "clocks_throttle_reasons.active", "retired_pages.pending"}, false},
+        // clocks.sm is printed as clocks.current.sm
+        {help, []string{"index", "uuid", "name", "fan.speed", "memory.used", "power.draw", "clocks.sm", "clocks_throttle_reasons.active", "retired_pages.pending"}, true},
+        {help, []string{"index", "uuid", "name", "fan.speed", "power.draw", "memory.used", "clocks.gr", "clocks_throttle_reasons.active", "retired_pages.pending"}, true},
+        {help, []string{"index", "uuid", "name"}, true},
+        // without help only the column count is checked
+        {nil, []string{"index", "uuid", "name", "fan.speed", "power.draw", "memory.used", "clocks.gr", "clocks_throttle_reasons.active", "retired_pages.pending"}, false},
+        {nil, []string{"index", "uuid", "name"}, true},
+    }
+    for _, tt := range tests {
+        if err := tt.help.checkHeader(header, tt.fields); (err != nil) != tt.err {
+            t.Errorf("checkHeader(%q) error %v, want error %v", tt.fields, err, tt.err)
+        }
+    }
+}
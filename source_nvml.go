@@ -0,0 +1,309 @@
+// +build linux,cgo
+
+package main
+
+import (
+    "context"
+    "encoding/xml"
+    "fmt"
+
+    "github.com/NVIDIA/go-nvml/pkg/nvml"
+)
+
+/**
+//===================================================
+//================ NVML SOURCE ======================
+//===================================================
+*/
+
+// nvmlSource reads the GPUs through the NVML library nvidia-smi is built
+// on, without starting a process per query. libnvidia-ml.so is loaded at
+// runtime. MIG devices, ECC error counts and a few other XML sections are
+// not read.
+type nvmlSource struct{}
+
+func newNVMLSource() (GPUSource, error) {
+    if ret := nvml.Init(); ret != nvml.SUCCESS {
+        return nil, fmt.Errorf("cannot initialise NVML: %v", ret)
+    }
+    return &nvmlSource{}, nil
+}
+
+// nvmlReading formats an NVML reading the way nvidia-smi prints it, so it
+// parses like the XML, or the text nvidia-smi prints when a reading fails.
+func nvmlReading(value interface{}, unit string, ret nvml.Return) string {
+    switch ret {
+    case nvml.SUCCESS:
+        if unit == "" {
+            return fmt.Sprint(value)
+        }
+        return fmt.Sprintf("%v %s", value, unit)
+    case nvml.ERROR_NOT_SUPPORTED:
+        return "[Not Supported]"
+    case nvml.ERROR_NO_PERMISSION:
+        return "[Insufficient Permissions]"
+    case nvml.ERROR_UNKNOWN:
+        return "Unknown Error"
+    }
+    return "N/A"
+}
+
+func nvmlEnabled(state nvml.EnableState, ret nvml.Return) string {
+    if ret == nvml.SUCCESS && state == nvml.FEATURE_ENABLED {
+        return "Enabled"
+    }
+    return nvmlReading("Disabled", "", ret)
+}
+
+// nvmlMiB returns bytes in MiB, the unit of the XML memory readings
+func nvmlMiB(bytes uint64) float64 {
+    return float64(bytes) / mebibyte
+}
+
+// nvmlWatts returns milliwatts in watts
+func nvmlWatts(milliwatts uint32) float64 {
+    return float64(milliwatts) / 1000
+}
+
+// nvmlInstanceID is the id NVML reports when a process is not on a MIG device
+const nvmlInstanceID = 0xFFFFFFFF
+
+// nvmlThrottleReasons are the bits of nvmlDeviceGetCurrentClocksThrottleReasons
+// by XML reason name
+var nvmlThrottleReasons = []struct {
+    name string
+    bit  uint64
+}{
+    {"gpu_idle", 1},
+    {"applications_clocks_setting", 2},
+    {"sw_power_cap", 4},
+    {"hw_slowdown", 8},
+    {"sync_boost", 16},
+    {"sw_thermal_slowdown", 32},
+    {"hw_thermal_slowdown", 64},
+    {"hw_power_brake_slowdown", 128},
+    {"display_clock_setting", 256},
+}
+
+func (s *nvmlSource) Query(ctx context.Context) (*NvidiaSmiLog, error) {
+    var l NvidiaSmiLog
+
+    driver, ret := nvml.SystemGetDriverVersion()
+    if ret != nvml.SUCCESS {
+        return nil, fmt.Errorf("cannot read the driver version: %v", ret)
+    }
+    l.DriverVersion = driver
+
+    count, ret := nvml.DeviceGetCount()
+    if ret != nvml.SUCCESS {
+        return nil, fmt.Errorf("cannot count GPUs: %v", ret)
+    }
+    l.AttachedGPUs = fmt.Sprint(count)
+
+    for i := 0; i < count; i++ {
+        if err := ctx.Err(); err != nil {
+            return nil, err
+        }
+        device, ret := nvml.DeviceGetHandleByIndex(i)
+        if ret != nvml.SUCCESS {
+            return nil, fmt.Errorf("cannot open GPU %d: %v", i, ret)
+        }
+        l.GPUs = append(l.GPUs, nvmlGPU(device))
+    }
+    return &l, nil
+}
+
+// nvmlGPU reads one GPU into the model of a <gpu> element.
+func nvmlGPU(device nvml.Device) NvidiaSmiGPU {
+    var g NvidiaSmiGPU
+
+    g.ProductName, _ = device.GetName()
+    g.UUID, _ = device.GetUUID()
+    g.Serial, _ = device.GetSerial()
+    g.VBiosVersion, _ = device.GetVbiosVersion()
+    minor, ret := device.GetMinorNumber()
+    g.MinorNumber = nvmlReading(minor, "", ret)
+
+    if pci, ret := device.GetPciInfo(); ret == nvml.SUCCESS {
+        var busID []byte
+        for _, c := range pci.BusId {
+            if c == 0 {
+                break
+            }
+            busID = append(busID, byte(c))
+        }
+        g.PCI.PCIBusID = string(busID)
+    }
+    gen, ret := device.GetCurrPcieLinkGeneration()
+    g.PCI.LinkInfo.PCIeGen.CurrentLinkGen = nvmlReading(gen, "", ret)
+    gen, ret = device.GetMaxPcieLinkGeneration()
+    g.PCI.LinkInfo.PCIeGen.MaxLinkGen = nvmlReading(gen, "", ret)
+    width, ret := device.GetCurrPcieLinkWidth()
+    g.PCI.LinkInfo.LinkWidths.CurrentLinkWidth = nvmlReading(width, "x", ret)
+    width, ret = device.GetMaxPcieLinkWidth()
+    g.PCI.LinkInfo.LinkWidths.MaxLinkWidth = nvmlReading(width, "x", ret)
+    replays, ret := device.GetPcieReplayCounter()
+    g.PCI.ReplayCounter = nvmlReading(replays, "", ret)
+    tx, ret := device.GetPcieThroughput(nvml.PCIE_UTIL_TX_BYTES)
+    g.PCI.TxUtil = nvmlReading(tx, "KB/s", ret)
+    rx, ret := device.GetPcieThroughput(nvml.PCIE_UTIL_RX_BYTES)
+    g.PCI.RxUtil = nvmlReading(rx, "KB/s", ret)
+
+    speed, ret := device.GetFanSpeed()
+    g.FanSpeed = nvmlReading(speed, "%", ret)
+    if fans, ret := device.GetNumFans(); ret == nvml.SUCCESS {
+        for fan := 0; fan < fans; fan++ {
+            speed, ret := device.GetFanSpeed_v2(fan)
+            target, tret := device.GetTargetFanSpeed(fan)
+            g.Fans = append(g.Fans, Fan{
+                Speed:       nvmlReading(speed, "%", ret),
+                TargetSpeed: nvmlReading(target, "%", tret),
+            })
+        }
+    }
+
+    if memory, ret := device.GetMemoryInfo_v2(); ret == nvml.SUCCESS {
+        g.FbMemoryUsage.Total = nvmlReading(nvmlMiB(memory.Total), "MiB", ret)
+        g.FbMemoryUsage.Reserved = nvmlReading(nvmlMiB(memory.Reserved), "MiB", ret)
+        g.FbMemoryUsage.Used = nvmlReading(nvmlMiB(memory.Used), "MiB", ret)
+        g.FbMemoryUsage.Free = nvmlReading(nvmlMiB(memory.Free), "MiB", ret)
+    } else {
+        memory, ret := device.GetMemoryInfo()
+        g.FbMemoryUsage.Total = nvmlReading(nvmlMiB(memory.Total), "MiB", ret)
+        g.FbMemoryUsage.Used = nvmlReading(nvmlMiB(memory.Used), "MiB", ret)
+        g.FbMemoryUsage.Free = nvmlReading(nvmlMiB(memory.Free), "MiB", ret)
+    }
+    bar1, ret := device.GetBAR1MemoryInfo()
+    g.Bar1MemoryUsage.Total = nvmlReading(nvmlMiB(bar1.Bar1Total), "MiB", ret)
+    g.Bar1MemoryUsage.Used = nvmlReading(nvmlMiB(bar1.Bar1Used), "MiB", ret)
+    g.Bar1MemoryUsage.Free = nvmlReading(nvmlMiB(bar1.Bar1Free), "MiB", ret)
+
+    current, pending, ret := device.GetMigMode()
+    g.MigMode.Current = nvmlEnabled(nvml.EnableState(current), ret)
+    g.MigMode.Pending = nvmlEnabled(nvml.EnableState(pending), ret)
+
+    utilization, ret := device.GetUtilizationRates()
+    g.Utilization.GPUUtil = nvmlReading(utilization.Gpu, "%", ret)
+    g.Utilization.MemoryUtil = nvmlReading(utilization.Memory, "%", ret)
+    encoder, _, ret := device.GetEncoderUtilization()
+    g.Utilization.EncoderUtil = nvmlReading(encoder, "%", ret)
+    decoder, _, ret := device.GetDecoderUtilization()
+    g.Utilization.DecoderUtil = nvmlReading(decoder, "%", ret)
+
+    temp, ret := device.GetTemperature(nvml.TEMPERATURE_GPU)
+    g.Temperature.GPUTemp = nvmlReading(temp, "C", ret)
+    temp, ret = device.GetTemperatureThreshold(nvml.TEMPERATURE_THRESHOLD_SHUTDOWN)
+    g.Temperature.GPUTempMaxThreshold = nvmlReading(temp, "C", ret)
+    temp, ret = device.GetTemperatureThreshold(nvml.TEMPERATURE_THRESHOLD_SLOWDOWN)
+    g.Temperature.GPUTempSlowThreshold = nvmlReading(temp, "C", ret)
+    temp, ret = device.GetTemperatureThreshold(nvml.TEMPERATURE_THRESHOLD_GPU_MAX)
+    g.Temperature.GPUTempMaxGpuThreshold = nvmlReading(temp, "C", ret)
+    temp, ret = device.GetTemperatureThreshold(nvml.TEMPERATURE_THRESHOLD_MEM_MAX)
+    g.Temperature.GPUTempMaxMemThreshold = nvmlReading(temp, "C", ret)
+
+    if pstate, ret := device.GetPerformanceState(); ret == nvml.SUCCESS && pstate != nvml.PSTATE_UNKNOWN {
+        g.PerformanceState = fmt.Sprintf("P%d", pstate)
+    }
+    energy, ret := device.GetTotalEnergyConsumption()
+    g.TotalEnergyConsumption = nvmlReading(energy, "mJ", ret)
+
+    p := &g.PowerReadings
+    mode, ret := device.GetPowerManagementMode()
+    p.PowerManagement = nvmlEnabled(mode, ret)
+    power, ret := device.GetPowerUsage()
+    p.PowerDraw = nvmlReading(nvmlWatts(power), "W", ret)
+    power, ret = device.GetPowerManagementLimit()
+    p.PowerLimit = nvmlReading(nvmlWatts(power), "W", ret)
+    power, ret = device.GetEnforcedPowerLimit()
+    p.EnforcedPowerLimit = nvmlReading(nvmlWatts(power), "W", ret)
+    power, ret = device.GetPowerManagementDefaultLimit()
+    p.DefaultPowerLimit = nvmlReading(nvmlWatts(power), "W", ret)
+    min, max, ret := device.GetPowerManagementLimitConstraints()
+    p.MinPowerLimit = nvmlReading(nvmlWatts(min), "W", ret)
+    p.MaxPowerLimit = nvmlReading(nvmlWatts(max), "W", ret)
+
+    clocks := []struct {
+        clock nvml.ClockType
+        field func(c *Clocks) *string
+    }{
+        {nvml.CLOCK_GRAPHICS, func(c *Clocks) *string { return &c.GraphicsClock }},
+        {nvml.CLOCK_SM, func(c *Clocks) *string { return &c.SmClock }},
+        {nvml.CLOCK_MEM, func(c *Clocks) *string { return &c.MemClock }},
+        {nvml.CLOCK_VIDEO, func(c *Clocks) *string { return &c.VideoClock }},
+    }
+    for _, c := range clocks {
+        mhz, ret := device.GetClockInfo(c.clock)
+        *c.field(&g.Clocks) = nvmlReading(mhz, "MHz", ret)
+        mhz, ret = device.GetMaxClockInfo(c.clock)
+        *c.field(&g.MaxClocks) = nvmlReading(mhz, "MHz", ret)
+        if c.clock == nvml.CLOCK_GRAPHICS || c.clock == nvml.CLOCK_MEM {
+            mhz, ret = device.GetApplicationsClock(c.clock)
+            *c.field(&g.ApplicationsClocks) = nvmlReading(mhz, "MHz", ret)
+            mhz, ret = device.GetDefaultApplicationsClock(c.clock)
+            *c.field(&g.DefaultApplicationsClocks) = nvmlReading(mhz, "MHz", ret)
+        }
+    }
+    boost, boostDefault, ret := device.GetAutoBoostedClocksEnabled()
+    g.ClockPolicy.AutoBoost = nvmlEnabled(boost, ret)
+    g.ClockPolicy.AutoBoostDefault = nvmlEnabled(boostDefault, ret)
+
+    if reasons, ret := device.GetCurrentClocksThrottleReasons(); ret == nvml.SUCCESS {
+        for _, r := range nvmlThrottleReasons {
+            value := "Not Active"
+            if reasons&r.bit != 0 {
+                value = "Active"
+            }
+            g.ClocksThrottleReasons.Reasons = append(g.ClocksThrottleReasons.Reasons, ClockReason{
+                XMLName: xml.Name{Local: "clocks_throttle_reason_" + r.name},
+                Value:   value,
+            })
+        }
+    }
+
+    eccCurrent, eccPending, ret := device.GetEccMode()
+    g.EccMode.Current = nvmlEnabled(eccCurrent, ret)
+    g.EccMode.Pending = nvmlEnabled(eccPending, ret)
+
+    g.Processes.ProcessInfo = nvmlProcesses(device)
+    return g
+}
+
+// nvmlProcesses lists the compute and graphics processes of a GPU, a
+// process that is both is typed C+G like nvidia-smi does.
+func nvmlProcesses(device nvml.Device) []ProcessInfo {
+    var processes []ProcessInfo
+    index := map[uint32]int{}
+
+    add := func(infos []nvml.ProcessInfo, ret nvml.Return, typ string) {
+        if ret != nvml.SUCCESS {
+            return
+        }
+        for _, info := range infos {
+            if i, ok := index[info.Pid]; ok {
+                processes[i].Type = "C+G"
+                continue
+            }
+            name, ret := nvml.SystemGetProcessName(int(info.Pid))
+            p := ProcessInfo{
+                PID:               fmt.Sprint(info.Pid),
+                ProcessName:       nvmlReading(name, "", ret),
+                UsedMemory:        nvmlReading(nvmlMiB(info.UsedGpuMemory), "MiB", nvml.SUCCESS),
+                Type:              typ,
+                GPUInstanceId:     "N/A",
+                ComputeInstanceId: "N/A",
+            }
+            if info.GpuInstanceId != nvmlInstanceID {
+                p.GPUInstanceId = fmt.Sprint(info.GpuInstanceId)
+                p.ComputeInstanceId = fmt.Sprint(info.ComputeInstanceId)
+            }
+            index[info.Pid] = len(processes)
+            processes = append(processes, p)
+        }
+    }
+
+    compute, ret := device.GetComputeRunningProcesses()
+    add(compute, ret, "C")
+    graphics, ret := device.GetGraphicsRunningProcesses()
+    add(graphics, ret, "G")
+    return processes
+}
@@ -0,0 +1,12 @@
+// +build !linux !cgo
+
+package main
+
+import (
+    "fmt"
+)
+
+// newNVMLSource fails, the NVML source needs Linux and cgo.
+func newNVMLSource() (GPUSource, error) {
+    return nil, fmt.Errorf("the nvml source needs a linux build with cgo enabled")
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+/**
+//===================================================
+//================ TEMPERATURE ======================
+//===================================================
+*/
+
+// Temperature is the <temperature> section of a GPU in Celsius. Which
+// readings are present depends on the GPU and driver, memory_temp is only
+// reported for HBM parts and gpu_temp_tlimit by newer drivers.
+type Temperature struct {
+    GPUTemp string `xml:"gpu_temp"`
+    GPUTempTLimit string `xml:"gpu_temp_tlimit"`
+    MemoryTemp string `xml:"memory_temp"`
+    GPUTempMaxThreshold string `xml:"gpu_temp_max_threshold"`
+    GPUTempSlowThreshold string `xml:"gpu_temp_slow_threshold"`
+    GPUTempMaxGpuThreshold string `xml:"gpu_temp_max_gpu_threshold"`
+    GPUTempMaxMemThreshold string `xml:"gpu_temp_max_mem_threshold"`
+    GPUTargetTemperature string `xml:"gpu_target_temperature"`
+}
+
+type temperatureMetrics struct {
+    temperature *prometheus.Desc
+    headroom    *prometheus.Desc
+    threshold   *prometheus.Desc
+}
+
+func newTemperatureMetrics(gpuLabels []string) *temperatureMetrics {
+    return &temperatureMetrics{
+        temperature: newGPUDesc(gpuLabels,
+            "nvidia_temperature_celsius",
+            "Current temperature readings in Celsius. sensor is gpu (core) or memory (HBM).",
+            "sensor",
+        ),
+        headroom: newGPUDesc(gpuLabels,
+            "nvidia_temperature_headroom_celsius",
+            "Degrees Celsius left before the GPU starts to slow down (T.Limit), not a temperature.",
+        ),
+        threshold: newGPUDesc(gpuLabels,
+            "nvidia_temperature_threshold_celsius",
+            "Temperature thresholds in Celsius. threshold is shutdown (the GPU shuts down), slowdown (the GPU starts to slow), max_gpu and max_mem (the maximum operating temperature of the core and memory) or target (the temperature the GPU is steered towards).",
+            "threshold",
+        ),
+    }
+}
+
+func (m *temperatureMetrics) describe(ch chan<- *prometheus.Desc) {
+    ch <- m.temperature
+    ch <- m.headroom
+    ch <- m.threshold
+}
+
+func (m *temperatureMetrics) collect(s gpuSink, gpu []string, GPU *NvidiaSmiGPU) {
+    t := &GPU.Temperature
+    s.gpuGauge(m.temperature, gpu, "temperature.gpu_temp", t.GPUTemp, 1, "gpu")
+    s.gpuGauge(m.temperature, gpu, "temperature.memory_temp", t.MemoryTemp, 1, "memory")
+    s.gpuGauge(m.headroom, gpu, "temperature.gpu_temp_tlimit", t.GPUTempTLimit, 1)
+
+    s.gpuGauge(m.threshold, gpu, "temperature.gpu_temp_max_threshold", t.GPUTempMaxThreshold, 1, "shutdown")
+    s.gpuGauge(m.threshold, gpu, "temperature.gpu_temp_slow_threshold", t.GPUTempSlowThreshold, 1, "slowdown")
+    s.gpuGauge(m.threshold, gpu, "temperature.gpu_temp_max_gpu_threshold", t.GPUTempMaxGpuThreshold, 1, "max_gpu")
+    s.gpuGauge(m.threshold, gpu, "temperature.gpu_temp_max_mem_threshold", t.GPUTempMaxMemThreshold, 1, "max_mem")
+    s.gpuGauge(m.threshold, gpu, "temperature.gpu_target_temperature", t.GPUTargetTemperature, 1, "target")
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestTemperatureMetrics(t *testing.T) {
+    // only q-x-535.xml has gpu_temp_tlimit
+    for _, dump := range testDumps {
+        c := newDumpCollector(t, dump, CollectorOpts{})
+        testGolden(t, c, goldenName(dump, "temperature"),
+            "nvidia_temperature_celsius",
+            "nvidia_temperature_headroom_celsius",
+            "nvidia_temperature_threshold_celsius",
+        )
+    }
+}
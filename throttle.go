@@ -0,0 +1,65 @@
+package main
+
+import (
+    "encoding/xml"
+    "strings"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+/**
+//===================================================
+//================ CLOCK THROTTLE REASONS ===========
+//===================================================
+*/
+
+// ClockReasons is the <clocks_throttle_reasons> section of a GPU, renamed
+// <clocks_event_reasons> by newer drivers. Each child element is a reason
+// that is either Active or Not Active, eg.
+// <clocks_throttle_reason_hw_slowdown>Not Active</clocks_throttle_reason_hw_slowdown>
+// All children are kept so reasons added by newer drivers are exported too.
+type ClockReasons struct {
+    Reasons []ClockReason `xml:",any"`
+}
+
+// ClockReason is one reason element of ClockReasons.
+type ClockReason struct {
+    XMLName xml.Name
+    Value string `xml:",chardata"`
+}
+
+// prefixes of the reason elements, old and new driver names
+var clockReasonPrefixes = []string{"clocks_throttle_reason_", "clocks_event_reason_"}
+
+type throttleMetrics struct {
+    reason *prometheus.Desc
+}
+
+func newThrottleMetrics(gpuLabels []string) *throttleMetrics {
+    return &throttleMetrics{
+        reason: newGPUDesc(gpuLabels,
+            "nvidia_clock_throttle_reason",
+            "Whether a reason is reducing the GPU clocks (1 active, 0 not active), eg. gpu_idle, sw_power_cap, hw_thermal_slowdown, sw_thermal_slowdown.",
+            "reason",
+        ),
+    }
+}
+
+func (m *throttleMetrics) describe(ch chan<- *prometheus.Desc) {
+    ch <- m.reason
+}
+
+func (m *throttleMetrics) collect(s gpuSink, gpu []string, GPU *NvidiaSmiGPU) {
+    m.collectReasons(s, gpu, "clocks_throttle_reasons", &GPU.ClocksThrottleReasons)
+    m.collectReasons(s, gpu, "clocks_event_reasons", &GPU.ClocksEventReasons)
+}
+
+func (m *throttleMetrics) collectReasons(s gpuSink, gpu []string, section string, reasons *ClockReasons) {
+    for _, r := range reasons.Reasons {
+        name := r.XMLName.Local
+        for _, prefix := range clockReasonPrefixes {
+            name = strings.TrimPrefix(name, prefix)
+        }
+        s.gpuFlag(m.reason, gpu, section+"."+r.XMLName.Local, r.Value, name)
+    }
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestThrottleMetrics(t *testing.T) {
+    // clocks_throttle_reasons in q-x-470.xml, clocks_event_reasons in
+    // q-x-535.xml, both export the same reason labels
+    for _, dump := range testDumps {
+        c := newDumpCollector(t, dump, CollectorOpts{})
+        testGolden(t, c, goldenName(dump, "throttle"), "nvidia_clock_throttle_reason")
+    }
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+    "context"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/common/log"
+)
+
+/**
+//===================================================
+//================ TOPOLOGY =========================
+//===================================================
+*/
+
+// GPUTopology is the row of a GPU in the `nvidia-smi topo -m` matrix.
+type GPUTopology struct {
+    // Links are the connection to each peer GPU keyed by its index, eg.
+    // NV12, PIX, PXB, PHB, NODE or SYS
+    Links map[string]string
+    CPUAffinity string
+    NUMAAffinity string
+}
+
+// TopologyLink is the connection to a peer GPU of the same snapshot, the
+// peer is at PeerIndex in the -q -x dump.
+type TopologyLink struct {
+    Peer       *NvidiaSmiGPU
+    PeerIndex  int
+    Connection string
+}
+
+var ansiEscapeRegex = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+// parseTopology returns the row of each GPU of `nvidia-smi topo -m` keyed
+// by GPU index. Columns of NICs and rows after the GPUs (NICs, the legend)
+// are ignored.
+//
+//          GPU0    GPU1    NIC0    CPU Affinity    NUMA Affinity   GPU NUMA ID
+//  GPU0     X      NV12    SYS     0-63            0               N/A
+//  GPU1    NV12     X      SYS     0-63            0               N/A
+//
+// Columns are tab separated, sometimes by more than one tab, and the header
+// may be underlined with escape codes.
+func parseTopology(out []byte) map[int]*GPUTopology {
+    rows := map[int]*GPUTopology{}
+    var header []string
+    for _, line := range strings.Split(ansiEscapeRegex.ReplaceAllString(string(out), ""), "\n") {
+        var cells []string
+        for _, cell := range strings.Split(line, "\t") {
+            if cell = strings.TrimSpace(cell); cell != "" {
+                cells = append(cells, cell)
+            }
+        }
+        if len(cells) == 0 {
+            continue
+        }
+        if header == nil {
+            // the header has no row name, it starts at GPU0 where the
+            // row of GPU0 continues with X
+            if cells[0] == "GPU0" && (len(cells) == 1 || cells[1] != "X") {
+                header = cells
+            }
+            continue
+        }
+
+        index, err := strconv.Atoi(strings.TrimPrefix(cells[0], "GPU"))
+        if !strings.HasPrefix(cells[0], "GPU") || err != nil {
+            continue
+        }
+        row := &GPUTopology{Links: map[string]string{}}
+        for i, value := range cells[1:] {
+            if i >= len(header) {
+                break
+            }
+            switch column := header[i]; {
+            case column == "CPU Affinity":
+                row.CPUAffinity = value
+            case column == "NUMA Affinity":
+                row.NUMAAffinity = value
+            case strings.HasPrefix(column, "GPU") && value != "X":
+                if peer, err := strconv.Atoi(strings.TrimPrefix(column, "GPU")); err == nil {
+                    row.Links[strconv.Itoa(peer)] = value
+                }
+            }
+        }
+        rows[index] = row
+    }
+    return rows
+}
+
+// topologyCache runs `nvidia-smi topo -m` at most once per interval, the
+// topology only changes when hardware or the driver does.
+type topologyCache struct {
+    command  string
+    interval time.Duration
+
+    mtx     sync.Mutex
+    rows    map[int]*GPUTopology
+    updated time.Time
+}
+
+func newTopologyCache(command string, interval time.Duration) *topologyCache {
+    return &topologyCache{
+        command:  command,
+        interval: interval,
+    }
+}
+
+// get returns the cached topology, refreshing it when it is older than the
+// interval. A failed refresh keeps the previous topology until the next
+// interval.
+func (t *topologyCache) get(ctx context.Context) map[int]*GPUTopology {
+    t.mtx.Lock()
+    defer t.mtx.Unlock()
+
+    if !t.updated.IsZero() && time.Since(t.updated) < t.interval {
+        return t.rows
+    }
+    out, err := runCommand(ctx, t.command, "topo", "-m")
+    if err != nil {
+        if ctx.Err() == nil {
+            // retry on the next interval rather than every scrape
+            t.updated = time.Now()
+        }
+        log.Warnf("cannot query GPU topology: %v", err)
+        return t.rows
+    }
+    t.rows = parseTopology(out)
+    t.updated = time.Now()
+    return t.rows
+}
+
+// addTopology sets the Topology and the TopologyLinks of each GPU, topo -m
+// only names GPUs by index.
+func (l *NvidiaSmiLog) addTopology(rows map[int]*GPUTopology) {
+    for index, row := range rows {
+        GPU := l.findGPU(gpuRef{index: index})
+        if GPU == nil {
+            continue
+        }
+        GPU.Topology = row
+        for peer, connection := range row.Links {
+            peerIndex, _ := strconv.Atoi(peer)
+            if p := l.findGPU(gpuRef{index: peerIndex}); p != nil {
+                GPU.TopologyLinks = append(GPU.TopologyLinks, TopologyLink{Peer: p, PeerIndex: peerIndex, Connection: connection})
+            }
+        }
+        sort.Slice(GPU.TopologyLinks, func(a, b int) bool {
+            return GPU.TopologyLinks[a].PeerIndex < GPU.TopologyLinks[b].PeerIndex
+        })
+    }
+}
+
+type topologyMetrics struct {
+    gpuLabels []string
+    link      *prometheus.Desc
+    info      *prometheus.Desc
+}
+
+func newTopologyMetrics(gpuLabels []string) *topologyMetrics {
+    // the peer is labelled like the GPU, eg. peer_uuid when uuid is selected
+    var labels []string
+    for _, l := range gpuLabels {
+        labels = append(labels, "peer_"+l)
+    }
+    return &topologyMetrics{
+        gpuLabels: gpuLabels,
+        link: newGPUDesc(gpuLabels,
+            "nvidia_topology_link",
+            "How a GPU connects to a peer GPU, from nvidia-smi topo -m. The peer_* labels identify the peer like the GPU labels. connection is NV# (# bonded NVLinks), PIX, PXB, PHB, NODE or SYS. Always 1.",
+            append(labels, "connection")...,
+        ),
+        info: newGPUDesc(gpuLabels,
+            "nvidia_topology_info",
+            "CPU cores and NUMA node close to a GPU, from nvidia-smi topo -m. Always 1.",
+            "cpu_affinity", "numa_node",
+        ),
+    }
+}
+
+func (m *topologyMetrics) describe(ch chan<- *prometheus.Desc) {
+    ch <- m.link
+    ch <- m.info
+}
+
+func (m *topologyMetrics) collect(s gpuSink, gpu []string, GPU *NvidiaSmiGPU) {
+    t := GPU.Topology
+    if t == nil {
+        return
+    }
+    for _, l := range GPU.TopologyLinks {
+        peer := gpuLabelValues(m.gpuLabels, l.PeerIndex, l.Peer)
+        gauge(s.ch, m.link, 1, append(append(append([]string{}, gpu...), peer...), l.Connection)...)
+    }
+    gauge(s.ch, m.info, 1, append(append([]string{}, gpu...), t.CPUAffinity, t.NUMAAffinity)...)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+    "reflect"
+    "strconv"
+    "testing"
+)
+
+func TestParseTopology(t *testing.T) {
+    tests := []struct {
+        file string
+        want map[int]*GPUTopology
+    }{
+        {"topo-m.txt", map[int]*GPUTopology{
+            0: {Links: map[string]string{"1": "NV12", "2": "NV12", "3": "SYS"}, CPUAffinity: "0-31,64-95", NUMAAffinity: "0"},
+            1: {Links: map[string]string{"0": "NV12", "2": "NV12", "3": "SYS"}, CPUAffinity: "0-31,64-95", NUMAAffinity: "0"},
+            2: {Links: map[string]string{"0": "NV12", "1": "NV12", "3": "NV4"}, CPUAffinity: "32-63,96-127", NUMAAffinity: "1"},
+            3: {Links: map[string]string{"0": "SYS", "1": "SYS", "2": "NV4"}, CPUAffinity: "32-63,96-127", NUMAAffinity: "1"},
+        }},
+        {"topo-m-single.txt", map[int]*GPUTopology{
+            0: {Links: map[string]string{}, CPUAffinity: "0-11", NUMAAffinity: "0"},
+        }},
+    }
+    for _, tt := range tests {
+        got := parseTopology(readTestdata(t, tt.file))
+        if !reflect.DeepEqual(got, tt.want) {
+            for index, row := range got {
+                t.Logf("%s: GPU%d %+v", tt.file, index, *row)
+            }
+            t.Errorf("%s: unexpected topology", tt.file)
+        }
+    }
+}
+
+func TestParseTopologyEmpty(t *testing.T) {
+    for _, out := range []string{"", "No devices were found\n"} {
+        if got := parseTopology([]byte(out)); len(got) != 0 {
+            t.Errorf("parseTopology(%q) = %v, want no GPUs", out, got)
+        }
+    }
+}
+
+func TestAddTopology(t *testing.T) {
+    l := &NvidiaSmiLog{GPUs: []NvidiaSmiGPU{{UUID: "GPU-0"}, {UUID: "GPU-1"}, {UUID: "GPU-2"}}}
+    // GPU 3 of topo-m.txt is not in the dump
+    l.addTopology(parseTopology(readTestdata(t, "topo-m.txt")))
+
+    tests := []struct {
+        gpu   int
+        peers []string
+        conns []string
+    }{
+        {0, []string{"GPU-1", "GPU-2"}, []string{"NV12", "NV12"}},
+        {2, []string{"GPU-0", "GPU-1"}, []string{"NV12", "NV12"}},
+    }
+    for _, tt := range tests {
+        var peers, conns []string
+        for _, link := range l.GPUs[tt.gpu].TopologyLinks {
+            if gpuLabelValues([]string{"gpu"}, link.PeerIndex, link.Peer)[0] == strconv.Itoa(tt.gpu) {
+                t.Errorf("GPU %d links to itself", tt.gpu)
+            }
+            peers = append(peers, gpuLabelValues([]string{"uuid"}, link.PeerIndex, link.Peer)...)
+            conns = append(conns, link.Connection)
+        }
+        if !reflect.DeepEqual(peers, tt.peers) || !reflect.DeepEqual(conns, tt.conns) {
+            t.Errorf("GPU %d links to %q over %q, want %q over %q", tt.gpu, peers, conns, tt.peers, tt.conns)
+        }
+    }
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+    "regexp"
+    "strconv"
+    "strings"
+    "sync"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+/**
+//===================================================
+//================ VALUE PARSE  =====================
+//===================================================
+*/
+
+// valueStatus tells whether an nvidia-smi reading holds a number and,
+// if not, why.
+type valueStatus int
+
+const (
+    valueOK valueStatus = iota
+    // valueMissing is an element the driver does not output at all.
+    valueMissing
+    valueNotAvailable
+    valueNotSupported
+    valueNoPermission
+    valueUnknownError
+    // valueInvalid is any other text that does not start with a number.
+    valueInvalid
+)
+
+func (s valueStatus) String() string {
+    switch s {
+    case valueOK:
+        return "ok"
+    case valueMissing:
+        return "missing"
+    case valueNotAvailable:
+        return "not_available"
+    case valueNotSupported:
+        return "not_supported"
+    case valueNoPermission:
+        return "insufficient_permissions"
+    case valueUnknownError:
+        return "unknown_error"
+    }
+    return "invalid"
+}
+
+// smiValue is a parsed nvidia-smi reading.
+type smiValue struct {
+    Value  float64
+    Status valueStatus
+}
+
+// ok is true when the reading holds a number.
+func (v smiValue) ok() bool {
+    return v.Status == valueOK
+}
+
+// leading number of a reading, the unit that follows is ignored eg.
+// "54.25 W", "30 %", "1024 MiB", "16x"
+var valueNumber = regexp.MustCompile(`^[-+]?[0-9]*\.?[0-9]+([eE][-+]?[0-9]+)?`)
+
+// parseValue parses a reading as printed by nvidia-smi.
+func parseValue(raw string) smiValue {
+    v := strings.TrimSpace(raw)
+    switch strings.ToLower(strings.Trim(v, "[]")) {
+    case "":
+        return smiValue{Status: valueMissing}
+    case "n/a":
+        return smiValue{Status: valueNotAvailable}
+    case "not supported":
+        return smiValue{Status: valueNotSupported}
+    case "insufficient permissions", "no permission":
+        return smiValue{Status: valueNoPermission}
+    case "unknown error":
+        return smiValue{Status: valueUnknownError}
+    }
+
+    // bitmasks such as clocks_event_reasons.active are hex
+    if strings.HasPrefix(v, "0x") {
+        u, err := strconv.ParseUint(v[2:], 16, 64)
+        if err != nil {
+            return smiValue{Status: valueInvalid}
+        }
+        return smiValue{Value: float64(u), Status: valueOK}
+    }
+
+    n := valueNumber.FindString(v)
+    if n == "" {
+        return smiValue{Status: valueInvalid}
+    }
+    f, err := strconv.ParseFloat(n, 64)
+    if err != nil {
+        return smiValue{Status: valueInvalid}
+    }
+    return smiValue{Value: f, Status: valueOK}
+}
+
+// parseFlag parses an Enabled/Disabled style reading as 1 or 0.
+func parseFlag(raw string) smiValue {
+    switch strings.ToLower(strings.TrimSpace(raw)) {
+    case "enabled", "enable", "yes", "active", "on", "true", "supported":
+        return smiValue{Value: 1, Status: valueOK}
+    case "disabled", "disable", "no", "not active", "off", "false":
+        return smiValue{Value: 0, Status: valueOK}
+    }
+    return parseValue(raw)
+}
+
+// fieldErrors counts readings that were not a number, by label values.
+type fieldErrors struct {
+    mtx    sync.Mutex
+    counts map[string]*fieldErrorCount
+}
+
+type fieldErrorCount struct {
+    // gpu is the key of the gpu label values the labels start with
+    gpu    string
+    labels []string
+    count  float64
+}
+
+// inc counts a reading labelled by the gpu label values followed by the
+// field and reason.
+func (f *fieldErrors) inc(labels ...string) {
+    key := strings.Join(labels, "\xff")
+
+    f.mtx.Lock()
+    defer f.mtx.Unlock()
+    if f.counts == nil {
+        f.counts = map[string]*fieldErrorCount{}
+    }
+    e, ok := f.counts[key]
+    if !ok {
+        e = &fieldErrorCount{gpu: strings.Join(labels[:len(labels)-2], "\xff"), labels: labels}
+        f.counts[key] = e
+    }
+    e.count++
+}
+
+// retain drops the counts of GPUs whose label values are not in gpus, so
+// a GPU that is gone does not leave stale series behind.
+func (f *fieldErrors) retain(gpus [][]string) {
+    keep := make(map[string]bool, len(gpus))
+    for _, gpu := range gpus {
+        keep[strings.Join(gpu, "\xff")] = true
+    }
+
+    f.mtx.Lock()
+    defer f.mtx.Unlock()
+    for key, e := range f.counts {
+        if !keep[e.gpu] {
+            delete(f.counts, key)
+        }
+    }
+}
+
+// collect sends a counter for every label set seen so far.
+func (f *fieldErrors) collect(ch chan<- prometheus.Metric, desc *prometheus.Desc) {
+    f.mtx.Lock()
+    defer f.mtx.Unlock()
+    for _, e := range f.counts {
+        ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, e.count, e.labels...)
+    }
+}
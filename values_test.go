@@ -0,0 +1,93 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestParseValue(t *testing.T) {
+    tests := []struct {
+        raw    string
+        value  float64
+        status valueStatus
+    }{
+        // readings as printed in the -q -x dump and --format=csv,nounits
+        {"54.25 W", 54.25, valueOK},
+        {"30 %", 30, valueOK},
+        {"81920 MiB", 81920, valueOK},
+        {"1410 MHz", 1410, valueOK},
+        {"16x", 16, valueOK},
+        {"31 C", 31, valueOK},
+        {"-5 C", -5, valueOK},
+        {"1.234e+03", 1234, valueOK},
+        {" 61.50", 61.5, valueOK},
+        {"0x0000000000000001", 1, valueOK},
+        {"0x00000000000000A4", 164, valueOK},
+        {"", 0, valueMissing},
+        {"   ", 0, valueMissing},
+        {"N/A", 0, valueNotAvailable},
+        {"[N/A]", 0, valueNotAvailable},
+        {"[Not Supported]", 0, valueNotSupported},
+        {"Not Supported", 0, valueNotSupported},
+        {"[Insufficient Permissions]", 0, valueNoPermission},
+        {"No Permission", 0, valueNoPermission},
+        {"[Unknown Error]", 0, valueUnknownError},
+        {"Default", 0, valueInvalid},
+        {"0xZZ", 0, valueInvalid},
+    }
+    for _, tt := range tests {
+        v := parseValue(tt.raw)
+        if v.Status != tt.status || v.Value != tt.value {
+            t.Errorf("parseValue(%q) = %v %s, want %v %s", tt.raw, v.Value, v.Status, tt.value, tt.status)
+        }
+    }
+}
+
+func TestParseFlag(t *testing.T) {
+    tests := []struct {
+        raw    string
+        value  float64
+        status valueStatus
+    }{
+        {"Enabled", 1, valueOK},
+        {"Disabled", 0, valueOK},
+        {"Active", 1, valueOK},
+        {"Not Active", 0, valueOK},
+        {"Yes", 1, valueOK},
+        {"No", 0, valueOK},
+        {"On", 1, valueOK},
+        {"Off", 0, valueOK},
+        {"true", 1, valueOK},
+        {"False", 0, valueOK},
+        // falls back to parseValue
+        {"1", 1, valueOK},
+        {"N/A", 0, valueNotAvailable},
+        {"[Not Supported]", 0, valueNotSupported},
+        {"", 0, valueMissing},
+        {"Pending", 0, valueInvalid},
+    }
+    for _, tt := range tests {
+        v := parseFlag(tt.raw)
+        if v.Status != tt.status || v.Value != tt.value {
+            t.Errorf("parseFlag(%q) = %v %s, want %v %s", tt.raw, v.Value, v.Status, tt.value, tt.status)
+        }
+    }
+}
+
+func TestFieldErrorsRetain(t *testing.T) {
+    var f fieldErrors
+    f.inc("0", "fan_speed", "not_available")
+    f.inc("0", "fan_speed", "not_available")
+    f.inc("1", "fan_speed", "not_supported")
+    f.inc("1", "power_readings.power_draw", "not_available")
+
+    // GPU 1 fell off the bus
+    f.retain([][]string{{"0"}})
+    if len(f.counts) != 1 {
+        t.Fatalf("got %d counts after retain, want 1", len(f.counts))
+    }
+    for _, e := range f.counts {
+        if e.labels[0] != "0" || e.count != 2 {
+            t.Errorf("got %v %v, want the two GPU 0 readings", e.labels, e.count)
+        }
+    }
+}